@@ -0,0 +1,99 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+)
+
+// getBucketRegion returns the region of the bucket. When the bucket is queried
+// through an endpoint of another region, OSS rejects the request and names the
+// endpoint of the bucket in the error, which gives the region as well.
+func getBucketRegion(ctx context.Context, client ossClientInterface, bucket string) (string, error) {
+	result, err := client.GetBucketLocation(ctx, &ossv2.GetBucketLocationRequest{Bucket: ossv2.Ptr(bucket)})
+	if err != nil {
+		var serviceErr *ossv2.ServiceError
+		if errors.As(err, &serviceErr) {
+			var body struct {
+				Endpoint string `xml:"Endpoint"`
+			}
+			if xml.Unmarshal(serviceErr.Snapshot, &body) == nil && body.Endpoint != "" {
+				return regionFromEndpoint(body.Endpoint), nil
+			}
+		}
+		return "", errors.Wrapf(err, "failed to get location of bucket %s", bucket)
+	}
+
+	location := ossv2.ToString(result.LocationConstraint)
+	if location == "" {
+		return "", errors.Errorf("location of bucket %s is empty", bucket)
+	}
+	return strings.TrimPrefix(location, "oss-"), nil
+}
+
+// regionFromEndpoint returns the region of an OSS endpoint such as
+// oss-cn-shanghai.aliyuncs.com or oss-cn-shanghai-internal.aliyuncs.com
+func regionFromEndpoint(endpoint string) string {
+	host := strings.TrimSuffix(strings.ToLower(endpoint), ".aliyuncs.com")
+	return strings.TrimSuffix(strings.TrimPrefix(host, "oss-"), "-internal")
+}
+
+// selectOssEndpoint returns the endpoint of a bucket in bucketRegion, along with
+// the reason it was selected. A configured network type is kept. Otherwise the
+// internal endpoint is used when the plugin runs on ECS in the region of the
+// bucket, and the public endpoint when it does not.
+func selectOssEndpoint(bucketRegion, ecsRegion string, config map[string]string) (endpoint, reason string) {
+	public := getOssEndpoint(bucketRegion, config)
+	switch {
+	case config[networkTypeConfigKey] != "":
+		return public, fmt.Sprintf("%s is %s", networkTypeConfigKey, config[networkTypeConfigKey])
+	case !veleroForAck(config):
+		return public, "the plugin does not run on ECS"
+	case ecsRegion == bucketRegion:
+		return fmt.Sprintf("https://oss-%s-internal.aliyuncs.com", bucketRegion), "the plugin runs on ECS in the region of the bucket"
+	case ecsRegion == "":
+		return public, "the region of the plugin is unknown"
+	default:
+		return public, fmt.Sprintf("the plugin runs in region %s", ecsRegion)
+	}
+}
+
+// discoverBucketEndpoint finds the region of the bucket with client, and selects
+// the endpoint for it. It returns whether the endpoint or region of the
+// ObjectStore changed. If the region cannot be found, the endpoint derived from
+// the region of the plugin is kept.
+func (o *ObjectStore) discoverBucketEndpoint(client ossClientInterface, bucket, ecsRegion string, config map[string]string) bool {
+	ctx, cancel := o.retry.requestContext()
+	defer cancel()
+
+	bucketRegion, err := getBucketRegion(ctx, client, bucket)
+	if err != nil {
+		o.log.Warnf("failed to discover the region of bucket %s, using endpoint %s: %v", bucket, o.endpoint, err)
+		return false
+	}
+
+	endpoint, reason := selectOssEndpoint(bucketRegion, ecsRegion, config)
+	o.log.Infof("bucket %s is in region %s, using endpoint %s because %s", bucket, bucketRegion, endpoint, reason)
+	if endpoint == o.endpoint && bucketRegion == o.region {
+		return false
+	}
+	o.endpoint, o.region = endpoint, bucketRegion
+	return true
+}
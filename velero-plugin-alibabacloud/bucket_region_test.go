@@ -0,0 +1,189 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetBucketRegion(t *testing.T) {
+	tests := []struct {
+		name           string
+		result         *ossv2.GetBucketLocationResult
+		err            error
+		expectedRegion string
+		expectedError  string
+	}{
+		{
+			name:           "location of the bucket",
+			result:         &ossv2.GetBucketLocationResult{LocationConstraint: ossv2.Ptr("oss-cn-shanghai")},
+			expectedRegion: "cn-shanghai",
+		},
+		{
+			name: "endpoint of the bucket named by the error",
+			err: &ossv2.ServiceError{
+				StatusCode: 403,
+				Code:       "AccessDenied",
+				Snapshot: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Error>
+  <Code>AccessDenied</Code>
+  <Message>The bucket you are attempting to access must be addressed using the specified endpoint. Please send all future requests to this endpoint.</Message>
+  <Bucket>velero-backups</Bucket>
+  <Endpoint>oss-ap-southeast-1.aliyuncs.com</Endpoint>
+</Error>`),
+			},
+			expectedRegion: "ap-southeast-1",
+		},
+		{
+			name:          "access denied",
+			err:           &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied", Snapshot: []byte(`<Error><Code>AccessDenied</Code></Error>`)},
+			expectedError: "failed to get location of bucket velero-backups",
+		},
+		{
+			name:          "network error",
+			err:           errors.New("dial tcp: connection refused"),
+			expectedError: "connection refused",
+		},
+		{
+			name:          "empty location",
+			result:        &ossv2.GetBucketLocationResult{},
+			expectedError: "location of bucket velero-backups is empty",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := new(mockOSSClient)
+			client.On("GetBucketLocation", mock.Anything, mock.MatchedBy(func(req *ossv2.GetBucketLocationRequest) bool {
+				return ossv2.ToString(req.Bucket) == "velero-backups"
+			})).Return(tc.result, tc.err)
+
+			region, err := getBucketRegion(context.Background(), client, "velero-backups")
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedRegion, region)
+		})
+	}
+}
+
+func TestRegionFromEndpoint(t *testing.T) {
+	assert.Equal(t, "cn-shanghai", regionFromEndpoint("oss-cn-shanghai.aliyuncs.com"))
+	assert.Equal(t, "cn-shanghai", regionFromEndpoint("oss-cn-shanghai-internal.aliyuncs.com"))
+	assert.Equal(t, "us-west-1", regionFromEndpoint("OSS-US-WEST-1.ALIYUNCS.COM"))
+}
+
+func TestSelectOssEndpoint(t *testing.T) {
+	t.Setenv("VELERO_FOR_ACK", "")
+
+	tests := []struct {
+		name             string
+		bucketRegion     string
+		ecsRegion        string
+		config           map[string]string
+		expectedEndpoint string
+		expectedReason   string
+	}{
+		{
+			name:             "internal endpoint in the ECS region",
+			bucketRegion:     "cn-beijing",
+			ecsRegion:        "cn-beijing",
+			config:           map[string]string{},
+			expectedEndpoint: "https://oss-cn-beijing-internal.aliyuncs.com",
+			expectedReason:   "the plugin runs on ECS in the region of the bucket",
+		},
+		{
+			name:             "public endpoint in another region",
+			bucketRegion:     "cn-shanghai",
+			ecsRegion:        "cn-beijing",
+			config:           map[string]string{},
+			expectedEndpoint: "https://oss-cn-shanghai.aliyuncs.com",
+			expectedReason:   "the plugin runs in region cn-beijing",
+		},
+		{
+			name:             "public endpoint outside ECS",
+			bucketRegion:     "cn-beijing",
+			ecsRegion:        "cn-beijing",
+			config:           map[string]string{notOnECSConfigKey: "true"},
+			expectedEndpoint: "https://oss-cn-beijing.aliyuncs.com",
+			expectedReason:   "the plugin does not run on ECS",
+		},
+		{
+			name:             "public endpoint in an unknown region",
+			bucketRegion:     "cn-beijing",
+			config:           map[string]string{},
+			expectedEndpoint: "https://oss-cn-beijing.aliyuncs.com",
+			expectedReason:   "the region of the plugin is unknown",
+		},
+		{
+			name:             "configured network type is kept",
+			bucketRegion:     "cn-shanghai",
+			ecsRegion:        "cn-beijing",
+			config:           map[string]string{networkTypeConfigKey: networkTypeInternal},
+			expectedEndpoint: "https://oss-cn-shanghai-internal.aliyuncs.com",
+			expectedReason:   "network is internal",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, reason := selectOssEndpoint(tc.bucketRegion, tc.ecsRegion, tc.config)
+			assert.Equal(t, tc.expectedEndpoint, endpoint)
+			assert.Equal(t, tc.expectedReason, reason)
+		})
+	}
+}
+
+func TestDiscoverBucketEndpoint(t *testing.T) {
+	t.Setenv("VELERO_FOR_ACK", "")
+
+	t.Run("endpoint of the bucket region is selected", func(t *testing.T) {
+		client := new(mockOSSClient)
+		client.On("GetBucketLocation", mock.Anything, mock.Anything).Return(
+			&ossv2.GetBucketLocationResult{LocationConstraint: ossv2.Ptr("oss-cn-shanghai")}, nil)
+		o := &ObjectStore{log: newTestLogger(), endpoint: "https://oss-cn-beijing.aliyuncs.com", region: "cn-beijing"}
+
+		assert.True(t, o.discoverBucketEndpoint(client, "bucket", "cn-beijing", map[string]string{}))
+		assert.Equal(t, "https://oss-cn-shanghai.aliyuncs.com", o.endpoint)
+		assert.Equal(t, "cn-shanghai", o.region)
+	})
+
+	t.Run("internal endpoint of the ECS region is selected", func(t *testing.T) {
+		client := new(mockOSSClient)
+		client.On("GetBucketLocation", mock.Anything, mock.Anything).Return(
+			&ossv2.GetBucketLocationResult{LocationConstraint: ossv2.Ptr("oss-cn-beijing")}, nil)
+		o := &ObjectStore{log: newTestLogger(), endpoint: "https://oss-cn-beijing.aliyuncs.com", region: "cn-beijing"}
+
+		assert.True(t, o.discoverBucketEndpoint(client, "bucket", "cn-beijing", map[string]string{}))
+		assert.Equal(t, "https://oss-cn-beijing-internal.aliyuncs.com", o.endpoint)
+	})
+
+	t.Run("endpoint is kept when the region cannot be found", func(t *testing.T) {
+		client := new(mockOSSClient)
+		client.On("GetBucketLocation", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused"))
+		o := &ObjectStore{log: newTestLogger(), endpoint: "https://oss-cn-beijing.aliyuncs.com", region: "cn-beijing"}
+
+		assert.False(t, o.discoverBucketEndpoint(client, "bucket", "cn-beijing", map[string]string{}))
+		assert.Equal(t, "https://oss-cn-beijing.aliyuncs.com", o.endpoint)
+		assert.Equal(t, "cn-beijing", o.region)
+	})
+}
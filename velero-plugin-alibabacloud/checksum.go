@@ -0,0 +1,57 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/crc64"
+	"strconv"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+)
+
+// crc64Table is the CRC-64/ECMA table OSS uses for x-oss-hash-crc64ecma
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// checksumMismatchError is returned when the CRC64 of the bytes sent or received
+// differs from the one stored by OSS, meaning the object is corrupted
+type checksumMismatchError struct {
+	bucket   string
+	key      string
+	expected uint64 // CRC64 stored by OSS
+	actual   uint64 // CRC64 of the bytes sent or received
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("object %s in bucket %s is corrupted: CRC64 is %d, expected %d", e.key, e.bucket, e.actual, e.expected)
+}
+
+// parseCRC64 parses an x-oss-hash-crc64ecma value, ok is false if OSS returned none
+func parseCRC64(value *string) (crc uint64, ok bool) {
+	if value == nil {
+		return 0, false
+	}
+	crc, err := strconv.ParseUint(ossv2.ToString(value), 10, 64)
+	return crc, err == nil
+}
+
+// verifyCRC64 compares the CRC64 computed by the plugin with the one returned by
+// OSS. Objects for which OSS returned no CRC64 are not verified.
+func verifyCRC64(bucket, key string, serverCRC *string, actual uint64) error {
+	expected, ok := parseCRC64(serverCRC)
+	if !ok || expected == actual {
+		return nil
+	}
+	return &checksumMismatchError{bucket: bucket, key: key, expected: expected, actual: actual}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"hash/crc64"
+	"testing"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCRC64(t *testing.T) {
+	// CRC-64/ECMA check value of "123456789" as computed by OSS
+	const check = "11051210869376104954"
+	actual := crc64.Checksum([]byte("123456789"), crc64Table)
+
+	tests := []struct {
+		name      string
+		serverCRC *string
+		actual    uint64
+		mismatch  bool
+	}{
+		{
+			name:      "matching checksum",
+			serverCRC: ossv2.Ptr(check),
+			actual:    actual,
+		},
+		{
+			name:      "mismatching checksum",
+			serverCRC: ossv2.Ptr(check),
+			actual:    actual + 1,
+			mismatch:  true,
+		},
+		{
+			name:   "no checksum from OSS",
+			actual: actual,
+		},
+		{
+			name:      "unparsable checksum from OSS",
+			serverCRC: ossv2.Ptr("not-a-crc"),
+			actual:    actual,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyCRC64("bucket", "backups/b1/b1.tar.gz", tc.serverCRC, tc.actual)
+			if !tc.mismatch {
+				assert.NoError(t, err)
+				return
+			}
+			var mismatch *checksumMismatchError
+			assert.ErrorAs(t, err, &mismatch)
+			assert.ErrorContains(t, err, "object backups/b1/b1.tar.gz in bucket bucket is corrupted")
+		})
+	}
+}
@@ -3,27 +3,99 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AliyunContainerService/ack-ram-tool/pkg/ecsmetadata"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 )
 
 var MetaClient = ecsmetadata.DefaultClient
-var MetaRegion string
-var MetaZone string
+
+// MetaRegion and MetaZone cache the region and zone of the instance, they are
+// looked up by concurrent Init calls of the locations
+var (
+	metaMu     sync.Mutex
+	MetaRegion string
+	MetaZone   string
+)
 
 const (
-	regionConfigKey      = "region"
-	zoneConfigKey        = "zone"
-	networkTypeConfigKey = "network"
-	endpointConfigKey    = "endpoint"
-	notOnECSConfigKey    = "notOnECS"
-	credFileConfigKey    = "credentialsFile"
+	regionConfigKey         = "region"
+	ossRegionConfigKey      = "ossRegion"
+	ecsRegionConfigKey      = "ecsRegion"
+	zoneConfigKey           = "zone"
+	networkTypeConfigKey    = "network"
+	endpointConfigKey       = "endpoint"
+	publicEndpointConfigKey = "publicEndpoint"
+	notOnECSConfigKey       = "notOnECS"
+	credFileConfigKey       = "credentialsFile"
+
+	uploadPartSizeConfigKey    = "uploadPartSize"
+	uploadConcurrencyConfigKey = "uploadConcurrency"
+
+	downloadRangeSizeConfigKey   = "downloadRangeSize"
+	downloadConcurrencyConfigKey = "downloadConcurrency"
+
+	uploadBandwidthLimitConfigKey   = "uploadBandwidthLimit"
+	downloadBandwidthLimitConfigKey = "downloadBandwidthLimit"
+
+	cseKeyFileConfigKey  = "clientSideEncryptionKeyFile"
+	cseKMSKeyIDConfigKey = "clientSideEncryptionKMSKeyID"
+
+	sseConfigKey                = "serverSideEncryption"
+	sseKeyIDConfigKey           = "serverSideEncryptionKeyID"
+	sseCustomerKeyFileConfigKey = "serverSideEncryptionCustomerKeyFile"
+
+	storageClassConfigKey   = "storageClass"
+	restoreTimeoutConfigKey = "restoreTimeout"
+
+	wormRetentionDaysConfigKey   = "wormRetentionDays"
+	wormConfigurePolicyConfigKey = "wormConfigurePolicy"
+
+	preflightCheckConfigKey = "preflightCheck"
+
+	mirrorBucketConfigKey          = "mirrorBucket"
+	mirrorRegionConfigKey          = "mirrorRegion"
+	mirrorEndpointConfigKey        = "mirrorEndpoint"
+	mirrorCredentialsFileConfigKey = "mirrorCredentialsFile"
+	mirrorFailurePolicyConfigKey   = "mirrorFailurePolicy"
+
+	replicaBucketConfigKey          = "replicaBucket"
+	replicaRegionConfigKey          = "replicaRegion"
+	replicaEndpointConfigKey        = "replicaEndpoint"
+	replicaCredentialsFileConfigKey = "replicaCredentialsFile"
+
+	oidcRoleArnConfigKey     = "oidcRoleArn"
+	oidcProviderArnConfigKey = "oidcProviderArn"
+	oidcTokenFileConfigKey   = "oidcTokenFile"
+	stsEndpointConfigKey     = "stsEndpoint"
+
+	roleArnConfigKey         = "roleArn"
+	roleSessionNameConfigKey = "roleSessionName"
+	externalIDConfigKey      = "externalId"
+
+	maxRetriesConfigKey       = "maxRetries"
+	retryBaseDelayConfigKey   = "retryBaseDelay"
+	retryMaxDelayConfigKey    = "retryMaxDelay"
+	connectTimeoutConfigKey   = "connectTimeout"
+	readWriteTimeoutConfigKey = "readWriteTimeout"
+	requestTimeoutConfigKey   = "requestTimeout"
+	transferTimeoutConfigKey  = "transferTimeout"
+
+	snapshotReadyTimeoutConfigKey = "snapshotReadyTimeout"
+	waitForSnapshotReadyConfigKey = "waitForSnapshotReady"
+	diskReadyTimeoutConfigKey     = "diskReadyTimeout"
+
+	instantAccessConfigKey              = "instantAccess"
+	instantAccessRetentionDaysConfigKey = "instantAccessRetentionDays"
 
 	networkTypeAccelerate = "accelerate"
 	networkTypeInternal   = "internal"
@@ -40,33 +112,151 @@ const (
 
 var validConfigKeys = []string{
 	regionConfigKey,
+	ossRegionConfigKey,
+	ecsRegionConfigKey,
 	zoneConfigKey,
 	networkTypeConfigKey,
 	endpointConfigKey,
+	publicEndpointConfigKey,
 	notOnECSConfigKey,
 	credFileConfigKey,
+	uploadPartSizeConfigKey,
+	uploadConcurrencyConfigKey,
+	downloadRangeSizeConfigKey,
+	downloadConcurrencyConfigKey,
+	uploadBandwidthLimitConfigKey,
+	downloadBandwidthLimitConfigKey,
+	cseKeyFileConfigKey,
+	cseKMSKeyIDConfigKey,
+	sseConfigKey,
+	sseKeyIDConfigKey,
+	sseCustomerKeyFileConfigKey,
+	storageClassConfigKey,
+	restoreTimeoutConfigKey,
+	wormRetentionDaysConfigKey,
+	wormConfigurePolicyConfigKey,
+	preflightCheckConfigKey,
+	mirrorBucketConfigKey,
+	mirrorRegionConfigKey,
+	mirrorEndpointConfigKey,
+	mirrorCredentialsFileConfigKey,
+	mirrorFailurePolicyConfigKey,
+	replicaBucketConfigKey,
+	replicaRegionConfigKey,
+	replicaEndpointConfigKey,
+	replicaCredentialsFileConfigKey,
+	oidcRoleArnConfigKey,
+	oidcProviderArnConfigKey,
+	oidcTokenFileConfigKey,
+	stsEndpointConfigKey,
+	roleArnConfigKey,
+	roleSessionNameConfigKey,
+	externalIDConfigKey,
+	maxRetriesConfigKey,
+	retryBaseDelayConfigKey,
+	retryMaxDelayConfigKey,
+	connectTimeoutConfigKey,
+	readWriteTimeoutConfigKey,
+	requestTimeoutConfigKey,
+	transferTimeoutConfigKey,
+	snapshotReadyTimeoutConfigKey,
+	waitForSnapshotReadyConfigKey,
+	diskReadyTimeoutConfigKey,
+	instantAccessConfigKey,
+	instantAccessRetentionDaysConfigKey,
 }
 
-// loadCredentialFileFromEnv loads environment variables from a credentials file.
+// getConfigSize parses a byte size from config. Both plain byte counts ("1048576")
+// and Kubernetes quantities ("64Mi") are accepted. defaultValue is returned when
+// the key is not set.
+func getConfigSize(config map[string]string, key string, defaultValue int64) (int64, error) {
+	value := strings.TrimSpace(config[key])
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid value %q for config key %s", value, key)
+	}
+
+	size, ok := quantity.AsInt64()
+	if !ok || size <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %s: must be a positive size", value, key)
+	}
+	return size, nil
+}
+
+// getConfigInt parses a positive integer from config. defaultValue is returned
+// when the key is not set.
+func getConfigInt(config map[string]string, key string, defaultValue int) (int, error) {
+	value := strings.TrimSpace(config[key])
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %s: must be a positive integer", value, key)
+	}
+	return n, nil
+}
+
+// getConfigDuration parses a positive duration such as "30m" from config.
+// defaultValue is returned when the key is not set.
+func getConfigDuration(config map[string]string, key string, defaultValue time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(config[key])
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %s: must be a positive duration", value, key)
+	}
+	return d, nil
+}
+
+// credentialsEnv holds the variables read from the credentials file of a backup
+// or volume snapshot location. Variables the file does not set are looked up in
+// the process environment, which is never modified, so that locations served by
+// the same plugin process keep their own credentials.
+type credentialsEnv map[string]string
+
+// Getenv returns the value of key from the credentials file, or from the process
+// environment if the file does not set it
+func (e credentialsEnv) Getenv(key string) string {
+	if value, ok := e[key]; ok {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// getCredentialsFilePath returns the path of the credentials file of a location.
 // The file path can be specified either via config["credentialsFile"] or the
 // ALIBABA_CLOUD_CREDENTIALS_FILE environment variable. Config takes precedence.
-func loadCredentialFileFromEnv(config map[string]string) error {
-	var filePath string
+func getCredentialsFilePath(config map[string]string) string {
 	if config != nil && config[credFileConfigKey] != "" {
-		filePath = config[credFileConfigKey]
-	} else {
-		// Deprecated
-		filePath = os.Getenv("ALIBABA_CLOUD_CREDENTIALS_FILE")
+		return config[credFileConfigKey]
 	}
+	// Deprecated
+	return os.Getenv("ALIBABA_CLOUD_CREDENTIALS_FILE")
+}
+
+// loadCredentialsEnv reads the variables of the credentials file of a location,
+// see getCredentialsFilePath
+func loadCredentialsEnv(config map[string]string) (credentialsEnv, error) {
+	filePath := getCredentialsFilePath(config)
 	if filePath == "" {
-		return nil
+		return credentialsEnv{}, nil
 	}
 
-	if err := godotenv.Overload(filePath); err != nil {
-		return errors.Wrapf(err, "error loading credientials file (%s)", filePath)
+	env, err := godotenv.Read(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading credientials file (%s)", filePath)
 	}
 
-	return nil
+	return env, nil
 }
 
 // getOssEndpoint:
@@ -96,13 +286,42 @@ func getOssEndpoint(region string, config map[string]string) string {
 
 }
 
-// getEcsRegionID return ecs region id
+// isCNameEndpoint returns whether endpoint is a custom domain mapped to a bucket
+// rather than an OSS endpoint
+func isCNameEndpoint(endpoint string) bool {
+	host := endpoint
+	if _, h, ok := strings.Cut(host, "://"); ok {
+		host = h
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return !strings.HasSuffix(strings.ToLower(host), ".aliyuncs.com")
+}
+
+// getOssRegionID returns the region of the OSS bucket from ossRegion, falling
+// back to region. It returns an empty string if neither is set.
+func getOssRegionID(config map[string]string) string {
+	if region := config[ossRegionConfigKey]; region != "" {
+		return region
+	}
+	return config[regionConfigKey]
+}
+
+// getEcsRegionID returns the ECS region from ecsRegion, falling back to region
+// and then to the region of the instance the plugin runs on
 func getEcsRegionID(config map[string]string) string {
+	if region := config[ecsRegionConfigKey]; region != "" {
+		return region
+	}
 	region := config[regionConfigKey]
 	if region != "" {
 		return region
 	}
 
+	metaMu.Lock()
+	defer metaMu.Unlock()
 	if MetaRegion != "" {
 		return MetaRegion
 	}
@@ -124,6 +343,8 @@ func getEcsZoneID(config map[string]string) string {
 		return zone
 	}
 
+	metaMu.Lock()
+	defer metaMu.Unlock()
 	if MetaZone != "" {
 		return MetaZone
 	}
@@ -143,18 +364,19 @@ func getRamRole() (string, error) {
 	return MetaClient.GetRoleName(context.Background())
 }
 
-// getSTSAK return AccessKeyID, AccessKeySecret and SecurityToken
-func getSTSAK(ramrole string) (string, string, string, error) {
-	// Use context with timeout to avoid hanging in non-ECS environments
-	// The timeout is set to 10 seconds to fail fast in test environments
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	roleInfo, err := MetaClient.GetRoleCredentials(ctx, ramrole)
+// getRoleCredentials returns the STS credentials of a RAM role from the ECS metadata service
+func getRoleCredentials(ctx context.Context, ramRole string) (*ossCredentials, error) {
+	roleInfo, err := MetaClient.GetRoleCredentials(ctx, ramRole)
 	if err != nil {
-		return "", "", "", err
+		return nil, err
 	}
-	return roleInfo.AccessKeyId, roleInfo.AccessKeySecret, roleInfo.SecurityToken, nil
+	return &ossCredentials{
+		accessKeyID:     roleInfo.AccessKeyId,
+		accessKeySecret: roleInfo.AccessKeySecret,
+		stsToken:        roleInfo.SecurityToken,
+		ramRole:         ramRole,
+		expiration:      roleInfo.Expiration,
+	}, nil
 }
 
 // ossCredentials holds OSS authentication credentials
@@ -163,6 +385,8 @@ type ossCredentials struct {
 	accessKeySecret string
 	stsToken        string
 	ramRole         string
+	oidc            *oidcConfig // Set for credentials of a role assumed with RRSA
+	expiration      time.Time   // Zero for credentials that do not expire
 }
 
 func veleroForAck(config map[string]string) bool {
@@ -178,46 +402,55 @@ func veleroForAck(config map[string]string) bool {
 //
 // 1. AccessKey credentials (highest priority):
 //   - Load from file (if ALIBABA_CLOUD_CREDENTIALS_FILE is set) and/or environment variables
+//   - Variables set in the file take precedence over the environment, which is left untouched
 //   - Environment variables: ALIBABA_CLOUD_ACCESS_KEY_ID, ALIBABA_CLOUD_ACCESS_KEY_SECRET
 //   - Optional: ALIBABA_CLOUD_ACCESS_STS_TOKEN
 //   - If both AccessKey ID and Secret are provided, they take precedence over RAM role
 //
-// 2. Custom RAM Role (via environment variable):
+// 2. RRSA (RAM Roles for Service Accounts):
+//   - Config keys oidcRoleArn, oidcProviderArn and oidcTokenFile, or the environment variables
+//     ALIBABA_CLOUD_ROLE_ARN, ALIBABA_CLOUD_OIDC_PROVIDER_ARN and ALIBABA_CLOUD_OIDC_TOKEN_FILE
+//   - The role is assumed with STS AssumeRoleWithOIDC, using the service account token projected into the pod
+//   - Works in both ACK and non-ACK environments
+//
+// 3. Custom RAM Role (via environment variable):
 //   - Environment variable: ALIBABA_CLOUD_RAM_ROLE
 //   - Allows specifying a custom RAM role name instead of using the ECS instance's default role
 //   - Works in both ACK and non-ACK environments
-//   - The function will use this role to obtain STS credentials via getSTSAK()
+//   - The function will use this role to obtain STS credentials via getRoleCredentials()
 //
-// 3. ECS Instance RAM Role (ACK environment fallback):
+// 4. ECS Instance RAM Role (ACK environment fallback):
 //   - For ACK environments: automatically detect the RAM role from ECS metadata
-//   - Only used if no AccessKey credentials and no custom RAM role are provided
+//   - Only used if no AccessKey credentials, no RRSA role and no custom RAM role are provided
 //   - Requires the ECS instance to have a RAM role attached
 //
-// 4. Error (non-ACK environment without credentials):
-//   - For non-ACK environments: returns error if no AccessKey and no custom RAM role are provided
+// 5. Error (non-ACK environment without credentials):
+//   - For non-ACK environments: returns error if no AccessKey, no RRSA role and no custom RAM role are provided
 //
 // Parameters:
 //   - config: configuration map that may contain:
 //   - "credentialsFile": path to credentials file (takes precedence over ALIBABA_CLOUD_CREDENTIALS_FILE env var)
 //   - "notOnECS": if set to "true", indicates not running on ECS (affects RAM role detection)
+//   - "oidcRoleArn", "oidcProviderArn", "oidcTokenFile": RRSA settings
+//   - "stsEndpoint": STS endpoint used to assume roles, defaults to sts.aliyuncs.com
 //
 // Returns:
-//   - ossCredentials: contains accessKeyID, accessKeySecret, stsToken, and ramRole
+//   - ossCredentials: contains accessKeyID, accessKeySecret, stsToken, and ramRole or oidc
 //   - error: if credentials cannot be obtained
 func getCredentials(config map[string]string) (*ossCredentials, error) {
 	cred := &ossCredentials{}
 
-	// Step 1: Load credentials from file if specified (this may set env vars)
-	if err := loadCredentialFileFromEnv(config); err != nil {
+	// Step 1: Load credentials from file if specified
+	env, err := loadCredentialsEnv(config)
+	if err != nil {
 		return nil, err
 	}
 
-	// Step 2: Get credentials from environment variables
-	// These may be set by loadCredentialFileFromEnv or directly by the user
-	cred.accessKeyID = os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID")
-	cred.accessKeySecret = os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET")
-	cred.stsToken = os.Getenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN") // Token may be empty
-	cred.ramRole = os.Getenv("ALIBABA_CLOUD_RAM_ROLE")          // Custom RAM role name
+	// Step 2: Get credentials from the file, falling back to environment variables
+	cred.accessKeyID = env.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID")
+	cred.accessKeySecret = env.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET")
+	cred.stsToken = env.Getenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN") // Token may be empty
+	cred.ramRole = env.Getenv("ALIBABA_CLOUD_RAM_ROLE")          // Custom RAM role name
 
 	// Step 3: If we have both accessKeyID and accessKeySecret, use them directly
 	// AccessKey credentials take precedence over RAM role
@@ -226,7 +459,18 @@ func getCredentials(config map[string]string) (*ossCredentials, error) {
 		return cred, nil
 	}
 
-	// Step 4: Handle RAM role authentication
+	// Step 4: Assume the RRSA role if configured
+	oidc, err := getOIDCConfig(config, env)
+	if err != nil {
+		return nil, err
+	}
+	if oidc != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialsFetchTimeout)
+		defer cancel()
+		return assumeRoleWithOIDC(ctx, oidc)
+	}
+
+	// Step 5: Handle RAM role authentication
 	// If no AccessKey credentials are available, try to use RAM role
 	if !veleroForAck(config) && cred.ramRole == "" {
 		// For non-ACK environment: if no AccessKey and no custom RAM role, return error
@@ -244,11 +488,13 @@ func getCredentials(config map[string]string) (*ossCredentials, error) {
 		cred.ramRole = ramRole
 	}
 
-	// Step 5: Get STS credentials from the RAM role
-	var err error
-	cred.accessKeyID, cred.accessKeySecret, cred.stsToken, err = getSTSAK(cred.ramRole)
+	// Step 6: Get STS credentials from the RAM role
+	// Use a timeout to fail fast in non-ECS environments
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsFetchTimeout)
+	defer cancel()
+	roleCred, err := getRoleCredentials(ctx, cred.ramRole)
 	if err != nil {
 		return nil, errors.Errorf("Failed to get sts token from ram role %s with err: %v", cred.ramRole, err)
 	}
-	return cred, nil
+	return roleCred, nil
 }
@@ -14,10 +14,17 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/AliyunContainerService/ack-ram-tool/pkg/ecsmetadata"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -75,6 +82,112 @@ func TestGetOssEndpoint(t *testing.T) {
 	}
 }
 
+func TestGetRegionIDs(t *testing.T) {
+	metaRegion := MetaRegion
+	MetaRegion = "cn-zhangjiakou"
+	defer func() { MetaRegion = metaRegion }()
+
+	tests := []struct {
+		name              string
+		config            map[string]string
+		expectedOssRegion string
+		expectedEcsRegion string
+	}{
+		{
+			name:              "region is used for both",
+			config:            map[string]string{regionConfigKey: "cn-beijing"},
+			expectedOssRegion: "cn-beijing",
+			expectedEcsRegion: "cn-beijing",
+		},
+		{
+			name: "separate regions take precedence over region",
+			config: map[string]string{
+				regionConfigKey:    "cn-beijing",
+				ossRegionConfigKey: "cn-shanghai",
+				ecsRegionConfigKey: "cn-hangzhou",
+			},
+			expectedOssRegion: "cn-shanghai",
+			expectedEcsRegion: "cn-hangzhou",
+		},
+		{
+			name:              "OSS region only",
+			config:            map[string]string{ossRegionConfigKey: "cn-shanghai"},
+			expectedOssRegion: "cn-shanghai",
+			expectedEcsRegion: "cn-zhangjiakou",
+		},
+		{
+			name:              "no region configured",
+			config:            map[string]string{},
+			expectedOssRegion: "",
+			expectedEcsRegion: "cn-zhangjiakou",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedOssRegion, getOssRegionID(tc.config))
+			assert.Equal(t, tc.expectedEcsRegion, getEcsRegionID(tc.config))
+		})
+	}
+}
+
+func TestGetEcsRegionAndZoneID_Concurrent(t *testing.T) {
+	var lookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		switch r.URL.Path {
+		case "/latest/meta-data/region-id":
+			fmt.Fprint(w, "cn-hangzhou")
+		case "/latest/meta-data/zone-id":
+			fmt.Fprint(w, "cn-hangzhou-h")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	metaClient, metaRegion, metaZone := MetaClient, MetaRegion, MetaZone
+	defer func() { MetaClient, MetaRegion, MetaZone = metaClient, metaRegion, metaZone }()
+	var err error
+	MetaClient, err = ecsmetadata.NewClient(ecsmetadata.ClientOptions{Endpoint: server.URL, DisableIMDSV2: true})
+	require.NoError(t, err)
+	MetaRegion, MetaZone = "", ""
+
+	// Locations are initialized concurrently, the instance metadata is looked up once
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "cn-hangzhou", getEcsRegionID(map[string]string{}))
+			assert.Equal(t, "cn-hangzhou-h", getEcsZoneID(map[string]string{}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), lookups.Load())
+}
+
+func TestIsCNameEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected bool
+	}{
+		{endpoint: "https://oss-cn-hangzhou.aliyuncs.com", expected: false},
+		{endpoint: "oss-cn-hangzhou.aliyuncs.com", expected: false},
+		{endpoint: "https://oss-accelerate.aliyuncs.com", expected: false},
+		{endpoint: "https://OSS-CN-HANGZHOU.ALIYUNCS.COM:443", expected: false},
+		{endpoint: "https://backups.example.com", expected: true},
+		{endpoint: "backups.example.com:8443", expected: true},
+		{endpoint: "http://backups.example.com/", expected: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.endpoint, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isCNameEndpoint(tc.endpoint))
+		})
+	}
+}
+
 func TestGetCredentials(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -180,6 +293,28 @@ ALIBABA_CLOUD_ACCESS_STS_TOKEN=config-file-token
 				assert.Empty(t, cred.ramRole)
 			},
 		},
+		{
+			name:   "success: credential file takes precedence over env",
+			config: nil,
+			setupEnv: func(t *testing.T) map[string]string {
+				credFile := filepath.Join(t.TempDir(), "credentials")
+				require.NoError(t, os.WriteFile(credFile, []byte(`ALIBABA_CLOUD_ACCESS_KEY_ID=file-ak
+ALIBABA_CLOUD_ACCESS_KEY_SECRET=file-sk
+`), 0644))
+
+				t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+				t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "env-ak")
+				t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "env-sk")
+				t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "env-token")
+				return map[string]string{"credentialsFile": credFile}
+			},
+			validateCred: func(t *testing.T, cred *ossCredentials) {
+				assert.Equal(t, "file-ak", cred.accessKeyID)
+				assert.Equal(t, "file-sk", cred.accessKeySecret)
+				assert.Equal(t, "env-token", cred.stsToken, "variables missing from the file fall back to env")
+				assert.Equal(t, "env-ak", os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID"), "env is not modified")
+			},
+		},
 		{
 			name:   "error: non-ACK environment without credentials",
 			config: map[string]string{"notOnECS": "true"},
@@ -500,3 +635,60 @@ func TestVeleroForAck(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConfigSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      int64
+		expectedError string
+	}{
+		{name: "unset uses default", value: "", expected: 42},
+		{name: "plain bytes", value: "1048576", expected: 1048576},
+		{name: "binary quantity", value: "64Mi", expected: 64 * 1024 * 1024},
+		{name: "decimal quantity", value: "5M", expected: 5000000},
+		{name: "invalid", value: "big", expectedError: "invalid value"},
+		{name: "zero", value: "0", expectedError: "must be a positive size"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			size, err := getConfigSize(map[string]string{"size": tc.value}, "size", 42)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, size)
+		})
+	}
+}
+
+func TestGetConfigInt(t *testing.T) {
+	n, err := getConfigInt(map[string]string{}, "n", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = getConfigInt(map[string]string{"n": "8"}, "n", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+
+	_, err = getConfigInt(map[string]string{"n": "-1"}, "n", 3)
+	assert.ErrorContains(t, err, "must be a positive integer")
+}
+
+func TestGetConfigDuration(t *testing.T) {
+	d, err := getConfigDuration(map[string]string{}, "d", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+
+	d, err = getConfigDuration(map[string]string{"d": "90m"}, "d", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, d)
+
+	_, err = getConfigDuration(map[string]string{"d": "0s"}, "d", time.Hour)
+	assert.ErrorContains(t, err, "must be a positive duration")
+
+	_, err = getConfigDuration(map[string]string{"d": "1 hour"}, "d", time.Hour)
+	assert.ErrorContains(t, err, "must be a positive duration")
+}
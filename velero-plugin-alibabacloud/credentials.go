@@ -0,0 +1,347 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	osscredentials "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
+	"github.com/aliyun/credentials-go/credentials"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// credentialsRefreshWindow is how long before expiry cached credentials are
+	// refreshed in the background, while still being handed out
+	credentialsRefreshWindow = 10 * time.Minute
+
+	// credentialsExpiryMargin is how long before expiry cached credentials are no
+	// longer used, so that requests in flight do not carry expired tokens
+	credentialsExpiryMargin = time.Minute
+
+	// credentialsFetchTimeout bounds a single credentials fetch
+	credentialsFetchTimeout = 10 * time.Second
+
+	// credentialsFileCheckInterval is how often the credentials file of a location
+	// is checked for changes
+	credentialsFileCheckInterval = 30 * time.Second
+)
+
+// credentialsFetcher fetches fresh credentials. A zero expiration means the
+// credentials do not expire.
+type credentialsFetcher func(ctx context.Context) (*ossCredentials, error)
+
+// credentialsProvider caches the credentials shared by the OSS, ECS and KMS
+// clients of an ObjectStore or VolumeSnapshotter. Expiring credentials are
+// refreshed in the background once they enter credentialsRefreshWindow, and
+// fetched synchronously only when they are about to expire. Credentials read
+// from a credentials file are reloaded when the file changes, see watchFile.
+type credentialsProvider struct {
+	log logrus.FieldLogger
+
+	mu         sync.Mutex
+	cred       *ossCredentials
+	fetch      credentialsFetcher
+	file       *credentialsFile // Nil unless the credentials come from a file
+	generation int              // Incremented when the credentials are reloaded from file
+	refreshing bool
+}
+
+// credentialsFile tracks the credentials file of a location, so that rotated
+// credentials are picked up without restarting the plugin
+type credentialsFile struct {
+	path     string
+	interval time.Duration
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+
+	// reload resolves the credentials of the location again from the changed file
+	reload func() (*ossCredentials, credentialsFetcher, error)
+}
+
+// newCachedCredentialsProvider returns a provider initially holding cred, which
+// is refreshed through fetch when it expires. fetch may be nil for credentials
+// that do not expire.
+func newCachedCredentialsProvider(log logrus.FieldLogger, cred *ossCredentials, fetch credentialsFetcher) *credentialsProvider {
+	return &credentialsProvider{log: log, cred: cred, fetch: fetch}
+}
+
+// get returns valid credentials, refreshing them when needed
+func (p *credentialsProvider) get(ctx context.Context) (*ossCredentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reloadIfChanged()
+
+	cred := p.cred
+	if cred.expiration.IsZero() || p.fetch == nil {
+		return cred, nil
+	}
+
+	untilExpiry := time.Until(cred.expiration)
+	if untilExpiry > credentialsRefreshWindow {
+		return cred, nil
+	}
+	if untilExpiry > credentialsExpiryMargin {
+		if !p.refreshing {
+			p.refreshing = true
+			go p.refresh(p.fetch, p.generation)
+		}
+		return cred, nil
+	}
+
+	cred, err := fetchWithTimeout(ctx, p.fetch)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to refresh credentials expiring at %s", p.cred.expiration.Format(time.RFC3339))
+	}
+	p.cred = cred
+	return cred, nil
+}
+
+// refresh fetches new credentials in the background. On failure the current
+// credentials are kept, and the next call to get tries again. The result is
+// dropped if the credentials were reloaded from file in the meantime.
+func (p *credentialsProvider) refresh(fetch credentialsFetcher, generation int) {
+	cred, err := fetchWithTimeout(context.Background(), fetch)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	if generation != p.generation {
+		return
+	}
+	if err != nil {
+		p.log.Warnf("failed to refresh credentials expiring at %s: %v", p.cred.expiration.Format(time.RFC3339), err)
+		return
+	}
+	p.cred = cred
+}
+
+func fetchWithTimeout(ctx context.Context, fetch credentialsFetcher) (*ossCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialsFetchTimeout)
+	defer cancel()
+	return fetch(ctx)
+}
+
+// watchFile makes the provider reload its credentials through reload whenever
+// the credentials file at path changes
+func (p *credentialsProvider) watchFile(path string, reload func() (*ossCredentials, credentialsFetcher, error)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat credentials file %s", path)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file = &credentialsFile{
+		path:     path,
+		interval: credentialsFileCheckInterval,
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		checked:  time.Now(),
+		reload:   reload,
+	}
+	return nil
+}
+
+// reloadIfChanged reloads the credentials when the credentials file changed since
+// it was last loaded. A file that cannot be loaded, for instance because it is
+// being rewritten, leaves the current credentials in place and is retried at the
+// next check. It must be called with p.mu held.
+func (p *credentialsProvider) reloadIfChanged() {
+	f := p.file
+	if f == nil || time.Since(f.checked) < f.interval {
+		return
+	}
+	f.checked = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		p.log.Warnf("failed to check credentials file %s, keeping current credentials: %v", f.path, err)
+		return
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+
+	cred, fetch, err := f.reload()
+	if err != nil {
+		p.log.Warnf("failed to reload changed credentials file %s, keeping current credentials: %v", f.path, err)
+		return
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	p.cred, p.fetch = cred, fetch
+	p.generation++
+	p.log.Infof("reloaded credentials from changed credentials file %s", f.path)
+}
+
+// GetCredentials implements the OSS SDK credentials provider
+func (p *credentialsProvider) GetCredentials(ctx context.Context) (osscredentials.Credentials, error) {
+	cred, err := p.get(ctx)
+	if err != nil {
+		return osscredentials.Credentials{}, err
+	}
+
+	result := osscredentials.Credentials{
+		AccessKeyID:     cred.accessKeyID,
+		AccessKeySecret: cred.accessKeySecret,
+		SecurityToken:   cred.stsToken,
+	}
+	if !cred.expiration.IsZero() {
+		result.Expires = &cred.expiration
+	}
+	return result, nil
+}
+
+// openapiCredential adapts credentialsProvider to the credential interface used
+// by the ECS and STS OpenAPI clients
+type openapiCredential struct {
+	provider *credentialsProvider
+}
+
+func (c *openapiCredential) GetCredential() (*credentials.CredentialModel, error) {
+	cred, err := c.provider.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	model := &credentials.CredentialModel{
+		AccessKeyId:     &cred.accessKeyID,
+		AccessKeySecret: &cred.accessKeySecret,
+		Type:            c.GetType(),
+	}
+	if cred.stsToken != "" {
+		model.SecurityToken = &cred.stsToken
+		model.Type = tea.String("sts")
+	}
+	return model, nil
+}
+
+func (c *openapiCredential) GetAccessKeyId() (*string, error) {
+	cred, err := c.GetCredential()
+	if err != nil {
+		return nil, err
+	}
+	return cred.AccessKeyId, nil
+}
+
+func (c *openapiCredential) GetAccessKeySecret() (*string, error) {
+	cred, err := c.GetCredential()
+	if err != nil {
+		return nil, err
+	}
+	return cred.AccessKeySecret, nil
+}
+
+func (c *openapiCredential) GetSecurityToken() (*string, error) {
+	cred, err := c.GetCredential()
+	if err != nil {
+		return nil, err
+	}
+	return cred.SecurityToken, nil
+}
+
+func (c *openapiCredential) GetBearerToken() *string {
+	return tea.String("")
+}
+
+func (c *openapiCredential) GetType() *string {
+	return tea.String("access_key")
+}
+
+// resolveCredentials resolves the base credentials of a location, see
+// getCredentials, and the fetcher that refreshes them when they expire
+func resolveCredentials(config map[string]string) (*ossCredentials, credentialsFetcher, error) {
+	cred, err := getCredentials(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fetch credentialsFetcher
+	switch {
+	case cred.oidc != nil:
+		oidc := cred.oidc
+		fetch = func(ctx context.Context) (*ossCredentials, error) {
+			return assumeRoleWithOIDC(ctx, oidc)
+		}
+	case cred.ramRole != "":
+		ramRole := cred.ramRole
+		fetch = func(ctx context.Context) (*ossCredentials, error) {
+			return getRoleCredentials(ctx, ramRole)
+		}
+	}
+	return cred, fetch, nil
+}
+
+// reloadCredentials resolves the credentials of a location again after its
+// credentials file changed. Files that look partially written are rejected
+// rather than falling back to other credential sources.
+func reloadCredentials(config map[string]string) (*ossCredentials, credentialsFetcher, error) {
+	env, err := loadCredentialsEnv(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(env) == 0 {
+		return nil, nil, errors.New("credentials file is empty")
+	}
+	_, hasID := env["ALIBABA_CLOUD_ACCESS_KEY_ID"]
+	_, hasSecret := env["ALIBABA_CLOUD_ACCESS_KEY_SECRET"]
+	if hasID != hasSecret {
+		return nil, nil, errors.New("credentials file sets only one of ALIBABA_CLOUD_ACCESS_KEY_ID and ALIBABA_CLOUD_ACCESS_KEY_SECRET")
+	}
+	return resolveCredentials(config)
+}
+
+// newCredentialsProviderFromConfig resolves the credentials configured for a
+// backup or volume snapshot location, see getCredentials. Credentials from a
+// credentials file are reloaded when the file changes. When roleArn is set, the
+// role is assumed on top of those base credentials, and assumed again with the
+// reloaded credentials when the assumed ones are refreshed.
+func newCredentialsProviderFromConfig(log logrus.FieldLogger, config map[string]string) (*credentialsProvider, error) {
+	role, err := getRoleConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, fetch, err := resolveCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	base := newCachedCredentialsProvider(log, cred, fetch)
+	if path := getCredentialsFilePath(config); path != "" {
+		if err := base.watchFile(path, func() (*ossCredentials, credentialsFetcher, error) {
+			return reloadCredentials(config)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if role == nil {
+		return base, nil
+	}
+
+	fetch = func(ctx context.Context) (*ossCredentials, error) {
+		return assumeRole(ctx, base, role)
+	}
+	cred, err = fetchWithTimeout(context.Background(), fetch)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedCredentialsProvider(log, cred, fetch), nil
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFetcher returns STS credentials expiring after validFor, numbered by fetch
+func countingFetcher(calls *atomic.Int32, validFor time.Duration, err error) credentialsFetcher {
+	return func(ctx context.Context) (*ossCredentials, error) {
+		n := calls.Add(1)
+		if err != nil {
+			return nil, err
+		}
+		return &ossCredentials{
+			accessKeyID:     "ak",
+			accessKeySecret: "sk",
+			stsToken:        "token-" + string(rune('0'+n)),
+			expiration:      time.Now().Add(validFor),
+		}, nil
+	}
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	t.Run("credentials without expiry are never refreshed", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, nil))
+
+		for i := 0; i < 100; i++ {
+			got, err := p.get(context.Background())
+			require.NoError(t, err)
+			assert.Same(t, cred, got)
+		}
+		assert.Zero(t, calls.Load())
+	})
+
+	t.Run("valid credentials are cached", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{stsToken: "token-0", expiration: time.Now().Add(time.Hour)}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, nil))
+
+		for i := 0; i < 100; i++ {
+			got, err := p.get(context.Background())
+			require.NoError(t, err)
+			assert.Same(t, cred, got)
+		}
+		assert.Zero(t, calls.Load())
+	})
+
+	t.Run("credentials close to expiry are refreshed in the background", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{stsToken: "token-0", expiration: time.Now().Add(credentialsRefreshWindow / 2)}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, nil))
+
+		got, err := p.get(context.Background())
+		require.NoError(t, err)
+		assert.Same(t, cred, got, "current credentials are handed out while refreshing")
+
+		assert.Eventually(t, func() bool {
+			got, err := p.get(context.Background())
+			return err == nil && got.stsToken == "token-1"
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("failed background refresh keeps current credentials", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{stsToken: "token-0", expiration: time.Now().Add(credentialsRefreshWindow / 2)}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, errors.New("metadata unavailable")))
+
+		_, err := p.get(context.Background())
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return calls.Load() == 1 && !p.refreshing
+		}, time.Second, time.Millisecond)
+
+		got, err := p.get(context.Background())
+		require.NoError(t, err)
+		assert.Same(t, cred, got)
+	})
+
+	t.Run("expired credentials are refreshed synchronously", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{stsToken: "token-0", expiration: time.Now().Add(credentialsExpiryMargin / 2)}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, nil))
+
+		got, err := p.get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", got.stsToken)
+
+		got, err = p.get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", got.stsToken)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("failed synchronous refresh is an error", func(t *testing.T) {
+		var calls atomic.Int32
+		cred := &ossCredentials{stsToken: "token-0", expiration: time.Now().Add(-time.Minute)}
+		p := newCachedCredentialsProvider(newTestLogger(), cred, countingFetcher(&calls, time.Hour, errors.New("metadata unavailable")))
+
+		_, err := p.get(context.Background())
+		assert.ErrorContains(t, err, "failed to refresh credentials expiring at")
+		assert.ErrorContains(t, err, "metadata unavailable")
+	})
+}
+
+func TestCredentialsProvider_SDKAdapters(t *testing.T) {
+	expiration := time.Now().Add(time.Hour)
+	p := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{
+		accessKeyID:     "ak",
+		accessKeySecret: "sk",
+		stsToken:        "token",
+		expiration:      expiration,
+	}, nil)
+
+	ossCred, err := p.GetCredentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ak", ossCred.AccessKeyID)
+	assert.Equal(t, "sk", ossCred.AccessKeySecret)
+	assert.Equal(t, "token", ossCred.SecurityToken)
+	require.NotNil(t, ossCred.Expires)
+	assert.Equal(t, expiration, *ossCred.Expires)
+
+	apiCred, err := (&openapiCredential{provider: p}).GetCredential()
+	require.NoError(t, err)
+	assert.Equal(t, "ak", *apiCred.AccessKeyId)
+	assert.Equal(t, "sk", *apiCred.AccessKeySecret)
+	assert.Equal(t, "token", *apiCred.SecurityToken)
+	assert.Equal(t, "sts", *apiCred.Type)
+
+	static := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil)
+	apiCred, err = (&openapiCredential{provider: static}).GetCredential()
+	require.NoError(t, err)
+	assert.Nil(t, apiCred.SecurityToken)
+	assert.Equal(t, "access_key", *apiCred.Type)
+}
+
+func TestCredentialsProvider_ReloadFile(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+	t.Setenv("ALIBABA_CLOUD_RAM_ROLE", "")
+
+	credFile := filepath.Join(t.TempDir(), "credentials")
+	modTime := time.Now()
+	writeCredentials := func(content string) {
+		require.NoError(t, os.WriteFile(credFile, []byte(content), 0600))
+		// Make every write visible to the check, whatever the file system time resolution
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(credFile, modTime, modTime))
+	}
+	writeCredentials("ALIBABA_CLOUD_ACCESS_KEY_ID=ak-1\nALIBABA_CLOUD_ACCESS_KEY_SECRET=sk-1\n")
+
+	p, err := newCredentialsProviderFromConfig(newTestLogger(), map[string]string{
+		credFileConfigKey: credFile,
+		notOnECSConfigKey: "true",
+	})
+	require.NoError(t, err)
+	p.file.interval = 0
+
+	accessKeyID := func() string {
+		cred, err := p.get(context.Background())
+		require.NoError(t, err)
+		return cred.accessKeyID
+	}
+	assert.Equal(t, "ak-1", accessKeyID())
+
+	writeCredentials("ALIBABA_CLOUD_ACCESS_KEY_ID=ak-2\nALIBABA_CLOUD_ACCESS_KEY_SECRET=sk-2\n")
+	assert.Equal(t, "ak-2", accessKeyID(), "rotated credentials are reloaded")
+
+	writeCredentials("")
+	assert.Equal(t, "ak-2", accessKeyID(), "truncated file is ignored")
+
+	writeCredentials("ALIBABA_CLOUD_ACCESS_KEY_ID=ak-3\n")
+	assert.Equal(t, "ak-2", accessKeyID(), "partially written file is ignored")
+
+	writeCredentials("ALIBABA_CLOUD_ACCESS_KEY_ID=ak-3\nALIBABA_CLOUD_ACCESS_KEY_SECRET=sk-3\n")
+	assert.Equal(t, "ak-3", accessKeyID(), "completed file is reloaded")
+
+	require.NoError(t, os.Remove(credFile))
+	assert.Equal(t, "ak-3", accessKeyID(), "removed file is ignored")
+
+	writeCredentials("ALIBABA_CLOUD_ACCESS_KEY_ID=ak-4\nALIBABA_CLOUD_ACCESS_KEY_SECRET=sk-4\n")
+	p.file.interval = time.Hour
+	assert.Equal(t, "ak-3", accessKeyID(), "file is not checked again before the interval")
+}
+
+func TestCredentialsProvider_ReloadDropsStaleRefresh(t *testing.T) {
+	release := make(chan struct{})
+	stale := func(ctx context.Context) (*ossCredentials, error) {
+		<-release
+		return &ossCredentials{accessKeyID: "stale", expiration: time.Now().Add(time.Hour)}, nil
+	}
+	p := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{
+		accessKeyID: "old",
+		expiration:  time.Now().Add(credentialsRefreshWindow / 2),
+	}, stale)
+
+	_, err := p.get(context.Background())
+	require.NoError(t, err)
+
+	// The file is reloaded while the background refresh with the old fetcher is in flight
+	p.mu.Lock()
+	p.cred = &ossCredentials{accessKeyID: "reloaded"}
+	p.fetch = nil
+	p.generation++
+	p.mu.Unlock()
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return !p.refreshing
+	}, time.Second, time.Millisecond)
+	cred, err := p.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "reloaded", cred.accessKeyID)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultDiskReadyTimeout is how long to wait for a restored disk to be
+	// available when diskReadyTimeout is not configured
+	defaultDiskReadyTimeout = 10 * time.Minute
+
+	// defaultDiskPollInterval is how often the disk status is checked
+	defaultDiskPollInterval = 5 * time.Second
+
+	// Disk statuses returned by DescribeDisks
+	diskStatusCreating  = "Creating"
+	diskStatusReIniting = "ReIniting"
+	diskStatusAvailable = "Available"
+	diskStatusAttaching = "Attaching"
+	diskStatusInUse     = "In_use"
+)
+
+// waitForDisk waits until the disk is available or diskReadyTimeout expires. A
+// disk that is already being attached is ready as well, any status other than
+// Creating is an error.
+func (b *VolumeSnapshotter) waitForDisk(diskID, zoneID string) error {
+	start := time.Now()
+	deadline := start.Add(b.diskReadyTimeout)
+	for {
+		status, err := b.getDiskStatus(diskID, zoneID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check status of disk %s", diskID)
+		}
+
+		switch status {
+		case diskStatusAvailable, diskStatusAttaching, diskStatusInUse:
+			b.log.Infof("disk %s is %s after %s", diskID, status, time.Since(start).Round(time.Second))
+			return nil
+		case "", diskStatusCreating, diskStatusReIniting:
+			// The disk may not be listed right after it is created
+		default:
+			return errors.Errorf("disk %s is in unexpected status %s", diskID, status)
+		}
+
+		if !time.Now().Before(deadline) {
+			return errors.Errorf("timed out after %s waiting for disk %s to be available (status %s), increase %s if needed",
+				b.diskReadyTimeout, diskID, status, diskReadyTimeoutConfigKey)
+		}
+		b.log.Infof("waiting for disk %s to be available (status %s), %s elapsed", diskID, status, time.Since(start).Round(time.Second))
+		time.Sleep(min(b.diskPollInterval, time.Until(deadline)))
+	}
+}
+
+// getDiskStatus returns the status of a disk, or an empty string when the disk
+// is not listed
+func (b *VolumeSnapshotter) getDiskStatus(diskID, zoneID string) (string, error) {
+	req := &ecs20140526.DescribeDisksRequest{
+		RegionId: tea.String(b.region),
+		DiskIds:  tea.String(fmt.Sprintf("[\"%s\"]", diskID)),
+	}
+	if zoneID != "" {
+		req.ZoneId = tea.String(zoneID)
+	}
+
+	res, err := b.client.DescribeDisks(req)
+	if err != nil {
+		return "", err
+	}
+	if res.Body == nil || res.Body.Disks == nil || len(res.Body.Disks.Disk) == 0 {
+		return "", nil
+	}
+	return tea.StringValue(res.Body.Disks.Disk[0].Status), nil
+}
+
+// deleteDisk deletes a disk that could not be restored. ECS only deletes disks
+// that are not being created, so the disk is given diskReadyTimeout once more to
+// leave Creating before it is deleted.
+func (b *VolumeSnapshotter) deleteDisk(diskID, zoneID string) error {
+	start := time.Now()
+	deadline := start.Add(b.diskReadyTimeout)
+	for {
+		status, err := b.getDiskStatus(diskID, zoneID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check status of disk %s", diskID)
+		}
+
+		if status == diskStatusCreating || status == diskStatusReIniting {
+			err = errors.Errorf("disk %s is %s", diskID, status)
+		} else {
+			_, err = b.client.DeleteDisk(&ecs20140526.DeleteDiskRequest{DiskId: tea.String(diskID)})
+			if err == nil {
+				b.log.Infof("deleted disk %s", diskID)
+				return nil
+			}
+			_, code, _ := getErrorStatus(err)
+			if code == "InvalidDiskId.NotFound" {
+				return nil
+			}
+			// The status of the disk changed since it was checked
+			if !strings.HasPrefix(code, "IncorrectDiskStatus") {
+				return errors.Wrapf(err, "failed to delete disk %s", diskID)
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			return errors.Wrapf(err, "timed out after %s waiting to delete disk %s", b.diskReadyTimeout, diskID)
+		}
+		b.log.Infof("waiting to delete disk %s: %v, %s elapsed", diskID, err, time.Since(start).Round(time.Second))
+		time.Sleep(min(b.diskPollInterval, time.Until(deadline)))
+	}
+}
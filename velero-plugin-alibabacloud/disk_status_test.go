@@ -0,0 +1,315 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// describeDisksResponse returns a DescribeDisks response with a disk in each of
+// the given statuses
+func describeDisksResponse(diskID string, statuses ...string) *ecs20140526.DescribeDisksResponse {
+	disks := []*ecs20140526.DescribeDisksResponseBodyDisksDisk{}
+	for _, status := range statuses {
+		disks = append(disks, &ecs20140526.DescribeDisksResponseBodyDisksDisk{
+			DiskId: tea.String(diskID),
+			Status: tea.String(status),
+			Tags:   &ecs20140526.DescribeDisksResponseBodyDisksDiskTags{},
+		})
+	}
+	return &ecs20140526.DescribeDisksResponse{
+		Body: &ecs20140526.DescribeDisksResponseBody{
+			Disks: &ecs20140526.DescribeDisksResponseBodyDisks{Disk: disks},
+		},
+	}
+}
+
+func TestWaitForDisk(t *testing.T) {
+	tests := []struct {
+		name          string
+		responses     []*ecs20140526.DescribeDisksResponse
+		describeErr   error
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:      "available disk",
+			responses: []*ecs20140526.DescribeDisksResponse{describeDisksResponse("d-123456", diskStatusAvailable)},
+			timeout:   time.Minute,
+		},
+		{
+			name: "creating disk is polled until available",
+			responses: []*ecs20140526.DescribeDisksResponse{
+				describeDisksResponse("d-123456"),
+				describeDisksResponse("d-123456", diskStatusCreating),
+				describeDisksResponse("d-123456", diskStatusAvailable),
+			},
+			timeout: time.Minute,
+		},
+		{
+			name:      "disk being attached",
+			responses: []*ecs20140526.DescribeDisksResponse{describeDisksResponse("d-123456", diskStatusAttaching)},
+			timeout:   time.Minute,
+		},
+		{
+			name:          "unexpected status",
+			responses:     []*ecs20140526.DescribeDisksResponse{describeDisksResponse("d-123456", "Error")},
+			timeout:       time.Minute,
+			expectedError: "disk d-123456 is in unexpected status Error",
+		},
+		{
+			name:          "timeout",
+			responses:     []*ecs20140526.DescribeDisksResponse{describeDisksResponse("d-123456", diskStatusCreating)},
+			expectedError: "waiting for disk d-123456 to be available (status Creating), increase diskReadyTimeout",
+		},
+		{
+			name:          "describe disk fails",
+			describeErr:   errors.New("throttled"),
+			timeout:       time.Minute,
+			expectedError: "failed to check status of disk d-123456: throttled",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+			for _, response := range test.responses {
+				client.On("DescribeDisks", mock.MatchedBy(func(req *ecs20140526.DescribeDisksRequest) bool {
+					return tea.StringValue(req.DiskIds) == `["d-123456"]` && tea.StringValue(req.ZoneId) == "cn-hangzhou-h"
+				})).Return(response, nil).Once()
+			}
+			if test.describeErr != nil {
+				client.On("DescribeDisks", mock.Anything).Return(nil, test.describeErr).Once()
+			}
+
+			b := &VolumeSnapshotter{
+				log:              newTestLogger(),
+				client:           client,
+				region:           "cn-hangzhou",
+				diskReadyTimeout: test.timeout,
+				diskPollInterval: time.Millisecond,
+			}
+
+			err := b.waitForDisk("d-123456", "cn-hangzhou-h")
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshot_WaitForDisk(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		deleteErr     error
+		expectedID    string
+		expectedError string
+	}{
+		{
+			name:       "disk available",
+			status:     diskStatusAvailable,
+			expectedID: "d-123456",
+		},
+		{
+			name:          "disk in unexpected status is deleted",
+			status:        "Error",
+			expectedError: "disk d-123456 is in unexpected status Error",
+		},
+		{
+			name:          "failure to delete disk is returned",
+			status:        "Error",
+			deleteErr:     errors.New("Forbidden.RAM"),
+			expectedError: "disk d-123456 is in unexpected status Error, and disk d-123456 could not be deleted, delete it manually: failed to delete disk d-123456: Forbidden.RAM",
+		},
+		{
+			name:          "disk already deleted",
+			status:        "Error",
+			deleteErr:     tea.NewSDKError(map[string]interface{}{"code": "InvalidDiskId.NotFound", "statusCode": 404}),
+			expectedError: "disk d-123456 is in unexpected status Error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+
+			client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%")), nil)
+			client.On("CreateDisk", mock.MatchedBy(func(req *ecs20140526.CreateDiskRequest) bool {
+				return tea.StringValue(req.SnapshotId) == "s-123456" && tea.StringValue(req.ZoneId) == "cn-hangzhou-h"
+			})).Return(&ecs20140526.CreateDiskResponse{
+				Body: &ecs20140526.CreateDiskResponseBody{DiskId: tea.String("d-123456")},
+			}, nil)
+			client.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-123456", test.status), nil)
+			if test.expectedError != "" {
+				client.On("DeleteDisk", mock.MatchedBy(func(req *ecs20140526.DeleteDiskRequest) bool {
+					return tea.StringValue(req.DiskId) == "d-123456"
+				})).Return(&ecs20140526.DeleteDiskResponse{}, test.deleteErr)
+			}
+
+			b := &VolumeSnapshotter{
+				log:                  newTestLogger(),
+				client:               client,
+				region:               "cn-hangzhou",
+				snapshotReadyTimeout: time.Minute,
+				diskReadyTimeout:     time.Minute,
+				diskPollInterval:     time.Millisecond,
+			}
+
+			volumeID, err := b.CreateVolumeFromSnapshot("s-123456", "cloud_essd", "cn-hangzhou-h", nil)
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				assert.Empty(t, volumeID)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedID, volumeID)
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshot_DeleteTimedOutDisk(t *testing.T) {
+	client := new(mockECSClient)
+	defer client.AssertExpectations(t)
+
+	// The disk is still being created when diskReadyTimeout expires, and becomes
+	// available later
+	start := time.Now()
+	disk := describeDisksResponse("d-123456", diskStatusCreating)
+	client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%")), nil)
+	client.On("CreateDisk", mock.Anything).Return(&ecs20140526.CreateDiskResponse{
+		Body: &ecs20140526.CreateDiskResponseBody{DiskId: tea.String("d-123456")},
+	}, nil)
+	client.On("DescribeDisks", mock.Anything).Run(func(mock.Arguments) {
+		if time.Since(start) > 80*time.Millisecond {
+			disk.Body.Disks.Disk[0].Status = tea.String(diskStatusAvailable)
+		}
+	}).Return(disk, nil)
+	client.On("DeleteDisk", mock.Anything).Return(&ecs20140526.DeleteDiskResponse{}, nil).Once()
+
+	b := &VolumeSnapshotter{
+		log:                  newTestLogger(),
+		client:               client,
+		region:               "cn-hangzhou",
+		snapshotReadyTimeout: time.Minute,
+		diskReadyTimeout:     50 * time.Millisecond,
+		diskPollInterval:     time.Millisecond,
+	}
+
+	volumeID, err := b.CreateVolumeFromSnapshot("s-123456", "cloud_essd", "cn-hangzhou-h", nil)
+	assert.ErrorContains(t, err, "timed out after 50ms waiting for disk d-123456 to be available")
+	assert.NotContains(t, err.Error(), "could not be deleted")
+	assert.Empty(t, volumeID)
+}
+
+func TestDeleteDisk(t *testing.T) {
+	incorrectStatus := tea.NewSDKError(map[string]interface{}{"code": "IncorrectDiskStatus", "statusCode": 403})
+
+	tests := []struct {
+		name          string
+		statuses      []string
+		deleteErrs    []error
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:       "available disk",
+			statuses:   []string{diskStatusAvailable},
+			deleteErrs: []error{nil},
+			timeout:    time.Minute,
+		},
+		{
+			name:       "creating disk is deleted once created",
+			statuses:   []string{diskStatusCreating, diskStatusCreating, diskStatusAvailable},
+			deleteErrs: []error{nil},
+			timeout:    time.Minute,
+		},
+		{
+			name:       "delete is retried while the disk status changes",
+			statuses:   []string{diskStatusAvailable, diskStatusAvailable},
+			deleteErrs: []error{incorrectStatus, nil},
+			timeout:    time.Minute,
+		},
+		{
+			name:       "disk already deleted",
+			statuses:   []string{""},
+			deleteErrs: []error{tea.NewSDKError(map[string]interface{}{"code": "InvalidDiskId.NotFound", "statusCode": 404})},
+			timeout:    time.Minute,
+		},
+		{
+			name:          "disk still creating",
+			statuses:      []string{diskStatusCreating},
+			expectedError: "timed out after 0s waiting to delete disk d-123456: disk d-123456 is Creating",
+		},
+		{
+			name:          "delete keeps failing with incorrect status",
+			statuses:      []string{diskStatusAvailable},
+			deleteErrs:    []error{incorrectStatus},
+			expectedError: "timed out after 0s waiting to delete disk d-123456",
+		},
+		{
+			name:          "delete fails",
+			statuses:      []string{diskStatusAvailable},
+			deleteErrs:    []error{errors.New("Forbidden.RAM")},
+			timeout:       time.Minute,
+			expectedError: "failed to delete disk d-123456: Forbidden.RAM",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+			for _, status := range test.statuses {
+				response := describeDisksResponse("d-123456")
+				if status != "" {
+					response = describeDisksResponse("d-123456", status)
+				}
+				client.On("DescribeDisks", mock.Anything).Return(response, nil).Once()
+			}
+			for _, err := range test.deleteErrs {
+				client.On("DeleteDisk", mock.MatchedBy(func(req *ecs20140526.DeleteDiskRequest) bool {
+					return tea.StringValue(req.DiskId) == "d-123456"
+				})).Return(&ecs20140526.DeleteDiskResponse{}, err).Once()
+			}
+
+			b := &VolumeSnapshotter{
+				log:              newTestLogger(),
+				client:           client,
+				region:           "cn-hangzhou",
+				diskReadyTimeout: test.timeout,
+				diskPollInterval: time.Millisecond,
+			}
+
+			err := b.deleteDisk("d-123456", "cn-hangzhou-h")
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
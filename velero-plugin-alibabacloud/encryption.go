@@ -0,0 +1,320 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/crypto"
+	"github.com/pkg/errors"
+)
+
+// kmsClientInterface defines the KMS operations used to wrap data keys
+// This allows for easier testing with mocks
+type kmsClientInterface interface {
+	Encrypt(request *kms.EncryptRequest) (*kms.EncryptResponse, error)
+	Decrypt(request *kms.DecryptRequest) (*kms.DecryptResponse, error)
+}
+
+// kmsClient is a KMS client using the credentials of a credentialsProvider.
+// The SDK client is recreated whenever the provider hands out new credentials.
+type kmsClient struct {
+	region      string
+	credentials *credentialsProvider
+
+	mu     sync.Mutex
+	cred   *ossCredentials
+	client *kms.Client
+}
+
+// newKmsClient creates a KMS client in the given region using the provided credentials
+func newKmsClient(region string, credentials *credentialsProvider) *kmsClient {
+	return &kmsClient{region: region, credentials: credentials}
+}
+
+// getClient returns an SDK client for the current credentials
+func (c *kmsClient) getClient() (*kms.Client, error) {
+	cred, err := c.credentials.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil && c.cred == cred {
+		return c.client, nil
+	}
+
+	var client *kms.Client
+	if len(cred.stsToken) > 0 {
+		client, err = kms.NewClientWithStsToken(c.region, cred.accessKeyID, cred.accessKeySecret, cred.stsToken)
+	} else {
+		client, err = kms.NewClientWithAccessKey(c.region, cred.accessKeyID, cred.accessKeySecret)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create KMS client")
+	}
+	c.cred, c.client = cred, client
+	return client, nil
+}
+
+func (c *kmsClient) Encrypt(request *kms.EncryptRequest) (*kms.EncryptResponse, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Encrypt(request)
+}
+
+func (c *kmsClient) Decrypt(request *kms.DecryptRequest) (*kms.DecryptResponse, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Decrypt(request)
+}
+
+// kmsMasterCipher implements crypto.MasterCipher with an Alibaba Cloud KMS key.
+// Data keys are sent to KMS base64 encoded, and the returned ciphertext blob is
+// what the OSS encryption client stores in the object metadata.
+type kmsMasterCipher struct {
+	keyID   string
+	matDesc string
+	client  kmsClientInterface
+}
+
+// GetWrapAlgorithm get master key wrap algorithm
+func (c *kmsMasterCipher) GetWrapAlgorithm() string {
+	return crypto.KmsAliCryptoWrap
+}
+
+// GetMatDesc get master key describe
+func (c *kmsMasterCipher) GetMatDesc() string {
+	return c.matDesc
+}
+
+// Encrypt wraps a data key with the KMS key
+func (c *kmsMasterCipher) Encrypt(plainData []byte) ([]byte, error) {
+	request := kms.CreateEncryptRequest()
+	request.KeyId = c.keyID
+	request.Plaintext = base64.StdEncoding.EncodeToString(plainData)
+
+	response, err := c.client.Encrypt(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encrypt data key with KMS key %s", c.keyID)
+	}
+	return []byte(response.CiphertextBlob), nil
+}
+
+// Decrypt unwraps a data key previously wrapped by Encrypt
+func (c *kmsMasterCipher) Decrypt(cryptoData []byte) ([]byte, error) {
+	request := kms.CreateDecryptRequest()
+	request.CiphertextBlob = string(cryptoData)
+
+	response, err := c.client.Decrypt(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt data key with KMS")
+	}
+
+	plainData, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode data key returned by KMS")
+	}
+	return plainData, nil
+}
+
+// newKmsMasterCipher creates a master cipher backed by the given KMS key
+func newKmsMasterCipher(keyID string, client kmsClientInterface) (crypto.MasterCipher, error) {
+	matDesc, err := json.Marshal(map[string]string{"kmsKeyId": keyID})
+	if err != nil {
+		return nil, err
+	}
+	return &kmsMasterCipher{keyID: keyID, matDesc: string(matDesc), client: client}, nil
+}
+
+// newRsaMasterCipher creates a master cipher from a PEM encoded RSA private key file.
+// The public key used for wrapping data keys is derived from the private key, and
+// its fingerprint is recorded in the object metadata to identify the master key.
+func newRsaMasterCipher(keyFile string) (crypto.MasterCipher, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read client-side encryption key file %s", keyFile)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("client-side encryption key file %s does not contain a PEM encoded key", keyFile)
+	}
+
+	var privateKey *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key any
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if privateKey, ok = key.(*rsa.PrivateKey); !ok {
+				err = errors.New("key is not an RSA private key")
+			}
+		}
+	default:
+		err = errors.Errorf("unsupported PEM block type %q, expected an RSA private key", block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse client-side encryption key file %s", keyFile)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal public key of %s", keyFile)
+	}
+	fingerprint := sha256.Sum256(publicKey)
+
+	return crypto.CreateMasterRsa(
+		map[string]string{"rsaKeyFingerprint": hex.EncodeToString(fingerprint[:8])},
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+		string(data),
+	)
+}
+
+// getMasterCipher returns the master cipher for client-side encryption, either
+// from an RSA key file or a KMS key ID, or nil if client-side encryption is disabled.
+func getMasterCipher(keyFile, kmsKeyID, region string, credentials *credentialsProvider) (crypto.MasterCipher, error) {
+	switch {
+	case keyFile != "" && kmsKeyID != "":
+		return nil, errors.Errorf("only one of %s and %s can be set", cseKeyFileConfigKey, cseKMSKeyIDConfigKey)
+	case keyFile != "":
+		return newRsaMasterCipher(keyFile)
+	case kmsKeyID != "":
+		return newKmsMasterCipher(kmsKeyID, newKmsClient(region, credentials))
+	default:
+		return nil, nil
+	}
+}
+
+// Server-side encryption modes accepted by the serverSideEncryption config key
+const (
+	sseModeAES256   = "AES256"
+	sseModeSM4      = "SM4"
+	sseModeKMS      = "KMS"
+	sseModeCustomer = "SSE-C"
+)
+
+// serverSideEncryption describes how OSS encrypts the objects of a backup storage location
+type serverSideEncryption struct {
+	algorithm   string // OSS managed encryption algorithm, empty with SSE-C
+	keyID       string // KMS key ID, empty for the OSS default KMS key
+	customerKey []byte // AES-256 key supplied with every request when using SSE-C
+}
+
+// getServerSideEncryption returns the server-side encryption configured for the
+// backup storage location, or nil if objects are stored without it. Without the
+// serverSideEncryption config key, the key ID in ALIBABA_CLOUD_ENCRYPTION_KEY_ID
+// enables SSE-KMS as before.
+func getServerSideEncryption(config map[string]string) (*serverSideEncryption, error) {
+	mode := strings.ToUpper(config[sseConfigKey])
+	keyID := config[sseKeyIDConfigKey]
+	keyFile := config[sseCustomerKeyFileConfigKey]
+
+	if mode == "" {
+		if keyID == "" {
+			keyID = os.Getenv("ALIBABA_CLOUD_ENCRYPTION_KEY_ID")
+		}
+		if keyID != "" {
+			mode = sseModeKMS
+		}
+	}
+	if keyID != "" && mode != sseModeKMS {
+		return nil, errors.Errorf("config key %s requires %s to be %s", sseKeyIDConfigKey, sseConfigKey, sseModeKMS)
+	}
+	if keyFile != "" && mode != sseModeCustomer {
+		return nil, errors.Errorf("config key %s requires %s to be %s", sseCustomerKeyFileConfigKey, sseConfigKey, sseModeCustomer)
+	}
+
+	switch mode {
+	case "":
+		return nil, nil
+	case sseModeAES256, sseModeSM4, sseModeKMS:
+		return &serverSideEncryption{algorithm: mode, keyID: keyID}, nil
+	case sseModeCustomer:
+		if keyFile == "" {
+			return nil, errors.Errorf("config key %s is required with %s %s", sseCustomerKeyFileConfigKey, sseConfigKey, sseModeCustomer)
+		}
+		key, err := readCustomerKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &serverSideEncryption{customerKey: key}, nil
+	default:
+		return nil, errors.Errorf("invalid value %q for config key %s: must be one of %s, %s, %s or %s",
+			config[sseConfigKey], sseConfigKey, sseModeAES256, sseModeSM4, sseModeKMS, sseModeCustomer)
+	}
+}
+
+// readCustomerKey reads an SSE-C key file holding either the raw 32 byte key or its base64 encoding
+func readCustomerKey(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read server-side encryption customer key file %s", keyFile)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.Errorf("server-side encryption customer key file %s must contain a 256-bit key, raw or base64 encoded", keyFile)
+	}
+	return key, nil
+}
+
+// applyTo sets the OSS managed encryption of an upload
+func (s *serverSideEncryption) applyTo(request *ossv2.PutObjectRequest) {
+	if s == nil || s.algorithm == "" {
+		return
+	}
+	request.ServerSideEncryption = ossv2.Ptr(s.algorithm)
+	if s.keyID != "" {
+		request.ServerSideEncryptionKeyId = ossv2.Ptr(s.keyID)
+	}
+}
+
+// headers returns the request headers carrying the SSE-C key, which OSS
+// requires on every request that writes or reads the object data
+func (s *serverSideEncryption) headers() map[string]string {
+	if s == nil || len(s.customerKey) == 0 {
+		return nil
+	}
+	sum := md5.Sum(s.customerKey)
+	return map[string]string{
+		ossv2.HeaderOssSSECAlgorithm: sseModeAES256,
+		ossv2.HeaderOssSSECKey:       base64.StdEncoding.EncodeToString(s.customerKey),
+		ossv2.HeaderOssSSECKeyMd5:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
@@ -0,0 +1,572 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/kms"
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKMSClient wraps data keys by prefixing them, standing in for KMS
+type fakeKMSClient struct {
+	keyIDs []string
+}
+
+func (f *fakeKMSClient) Encrypt(request *kms.EncryptRequest) (*kms.EncryptResponse, error) {
+	f.keyIDs = append(f.keyIDs, request.KeyId)
+	response := kms.CreateEncryptResponse()
+	response.CiphertextBlob = "wrapped:" + request.Plaintext
+	return response, nil
+}
+
+func (f *fakeKMSClient) Decrypt(request *kms.DecryptRequest) (*kms.DecryptResponse, error) {
+	response := kms.CreateDecryptResponse()
+	response.Plaintext = strings.TrimPrefix(request.CiphertextBlob, "wrapped:")
+	return response, nil
+}
+
+// writeTestRsaKey writes a new RSA private key to a temporary file in the given PEM format
+func writeTestRsaKey(t *testing.T, blockType string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var der []byte
+	if blockType == "PRIVATE KEY" {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+	} else {
+		der = x509.MarshalPKCS1PrivateKey(key)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "cse.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return keyFile
+}
+
+func TestNewRsaMasterCipher(t *testing.T) {
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, blockType := range []string{"RSA PRIVATE KEY", "PRIVATE KEY"} {
+		t.Run(blockType, func(t *testing.T) {
+			masterCipher, err := newRsaMasterCipher(writeTestRsaKey(t, blockType))
+			require.NoError(t, err)
+			assert.Equal(t, crypto.RsaCryptoWrap, masterCipher.GetWrapAlgorithm())
+			assert.Contains(t, masterCipher.GetMatDesc(), "rsaKeyFingerprint")
+
+			wrapped, err := masterCipher.Encrypt(dataKey)
+			require.NoError(t, err)
+			assert.NotEqual(t, dataKey, wrapped)
+
+			unwrapped, err := masterCipher.Decrypt(wrapped)
+			require.NoError(t, err)
+			assert.Equal(t, dataKey, unwrapped)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := newRsaMasterCipher(filepath.Join(t.TempDir(), "missing.pem"))
+		assert.ErrorContains(t, err, "failed to read client-side encryption key file")
+	})
+
+	t.Run("not a PEM file", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "cse.pem")
+		require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+
+		_, err := newRsaMasterCipher(keyFile)
+		assert.ErrorContains(t, err, "does not contain a PEM encoded key")
+	})
+
+	t.Run("not a private key", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "cse.pem")
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")}), 0600))
+
+		_, err := newRsaMasterCipher(keyFile)
+		assert.ErrorContains(t, err, "unsupported PEM block type")
+	})
+}
+
+func TestKmsMasterCipher(t *testing.T) {
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	client := &fakeKMSClient{}
+
+	masterCipher, err := newKmsMasterCipher("key-id", client)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.KmsAliCryptoWrap, masterCipher.GetWrapAlgorithm())
+	assert.Equal(t, `{"kmsKeyId":"key-id"}`, masterCipher.GetMatDesc())
+
+	wrapped, err := masterCipher.Encrypt(dataKey)
+	require.NoError(t, err)
+	assert.Equal(t, "wrapped:"+base64.StdEncoding.EncodeToString(dataKey), string(wrapped))
+	assert.Equal(t, []string{"key-id"}, client.keyIDs)
+
+	unwrapped, err := masterCipher.Decrypt(wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+}
+
+func TestGetMasterCipher(t *testing.T) {
+	cred := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil)
+
+	masterCipher, err := getMasterCipher("", "", "cn-hangzhou", cred)
+	require.NoError(t, err)
+	assert.Nil(t, masterCipher)
+
+	masterCipher, err = getMasterCipher("", "key-id", "cn-hangzhou", cred)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.KmsAliCryptoWrap, masterCipher.GetWrapAlgorithm())
+
+	_, err = getMasterCipher("/etc/cse.pem", "key-id", "cn-hangzhou", cred)
+	assert.ErrorContains(t, err, "only one of clientSideEncryptionKeyFile and clientSideEncryptionKMSKeyID can be set")
+}
+
+// fakeOSSObject is an object stored by fakeOSSServer
+type fakeOSSObject struct {
+	data        []byte
+	meta        http.Header
+	customerKey string
+}
+
+// fakeOSSServer is a minimal in-memory OSS endpoint for path-style requests,
+// supporting simple and multipart uploads, HEAD and ranged GET. Like OSS, it
+// rejects requests for SSE-C objects that do not carry the object's key.
+type fakeOSSServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*fakeOSSObject
+	uploads map[string]*fakeOSSObject
+	parts   map[string]map[int][]byte
+	started int // Number of multipart uploads started, numbering their upload IDs
+}
+
+func newFakeOSSServer(t *testing.T) *fakeOSSServer {
+	f := &fakeOSSServer{
+		objects: map[string]*fakeOSSObject{},
+		uploads: map[string]*fakeOSSObject{},
+		parts:   map[string]map[int][]byte{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newClient returns an OSS client for the fake server
+func (f *fakeOSSServer) newClient() *ossv2.Client {
+	cfg := ossv2.LoadDefaultConfig().
+		WithCredentialsProvider(newCachedCredentialsProvider(nil, &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil)).
+		WithEndpoint(f.URL).
+		WithRegion("cn-hangzhou").
+		WithUsePathStyle(true)
+	return ossv2.NewClient(cfg)
+}
+
+func userMeta(header http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-oss-meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (f *fakeOSSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(path) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := path[1]
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.started++
+		uploadID = fmt.Sprintf("upload-%d", f.started)
+		f.uploads[uploadID] = &fakeOSSObject{meta: userMeta(r.Header), customerKey: r.Header.Get(ossv2.HeaderOssSSECKey)}
+		f.parts[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		if r.Header.Get(ossv2.HeaderOssSSECKey) != f.uploads[uploadID].customerKey {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		f.parts[uploadID][partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf("\"part-%d\"", partNumber))
+
+	case r.Method == http.MethodPost && uploadID != "":
+		object := f.uploads[uploadID]
+		var numbers []int
+		for n := range f.parts[uploadID] {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		for _, n := range numbers {
+			object.data = append(object.data, f.parts[uploadID][n]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = &fakeOSSObject{data: data, meta: userMeta(r.Header), customerKey: r.Header.Get(ossv2.HeaderOssSSECKey)}
+		w.Header().Set("ETag", "\"etag\"")
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+		if r.Header.Get(ossv2.HeaderOssSSECKey) != object.customerKey {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for k, v := range object.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", "\"etag\"")
+
+		data := object.data
+		status := http.StatusOK
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestClientSideEncryption(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		cseKMSKeyID string
+	}{
+		{
+			name: "single part with RSA key",
+			size: 1000,
+		},
+		{
+			name: "multipart with RSA key",
+			size: 3*1024*1024 + 7,
+		},
+		{
+			name:        "multipart with KMS key",
+			size:        3*1024*1024 + 7,
+			cseKMSKeyID: "key-id",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeOSSServer(t)
+			o := &ObjectStore{
+				log:                 newTestLogger(),
+				region:              "cn-hangzhou",
+				uploadPartSize:      ossv2.MinPartSize,
+				uploadConcurrency:   2,
+				downloadRangeSize:   1000*1000 + 1,
+				downloadConcurrency: 2,
+			}
+
+			var masterCipher crypto.MasterCipher
+			var err error
+			if tc.cseKMSKeyID != "" {
+				masterCipher, err = newKmsMasterCipher(tc.cseKMSKeyID, &fakeKMSClient{})
+			} else {
+				masterCipher, err = newRsaMasterCipher(writeTestRsaKey(t, "RSA PRIVATE KEY"))
+			}
+			require.NoError(t, err)
+			encryption, err := ossv2.NewEncryptionClient(server.newClient(), masterCipher)
+			require.NoError(t, err)
+			o.client = &ossClientWrapper{client: server.newClient(), encryption: encryption}
+
+			data := newTestObject(tc.size)
+			require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", bytes.NewReader(data)))
+
+			stored := server.objects["backups/b1/b1.tar.gz"]
+			require.NotNil(t, stored)
+			assert.Len(t, stored.data, len(data))
+			assert.NotEqual(t, data, stored.data, "object should be stored encrypted")
+			assert.NotEmpty(t, stored.meta.Get(ossv2.OssClientSideEncryptionKey), "wrapped data key should be stored in metadata")
+
+			body, err := o.GetObject("bucket", "backups/b1/b1.tar.gz")
+			require.NoError(t, err)
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestInitClientSideEncryption(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expectedError string
+	}{
+		{
+			name: "both master keys",
+			config: map[string]string{
+				"region":             "cn-hangzhou",
+				cseKeyFileConfigKey:  "/etc/cse.pem",
+				cseKMSKeyIDConfigKey: "key-id",
+			},
+			expectedError: "only one of clientSideEncryptionKeyFile and clientSideEncryptionKMSKeyID can be set",
+		},
+		{
+			name: "unaligned part size",
+			config: map[string]string{
+				"region":                "cn-hangzhou",
+				cseKMSKeyIDConfigKey:    "key-id",
+				uploadPartSizeConfigKey: "1000001",
+			},
+			expectedError: "must be a multiple of 16 bytes with client-side encryption",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newObjectStore(newTestLogger()).Init(tc.config)
+			assert.ErrorContains(t, err, tc.expectedError)
+		})
+	}
+
+	t.Run("SSE-C", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "ssec.key")
+		require.NoError(t, os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600))
+
+		err := newObjectStore(newTestLogger()).Init(map[string]string{
+			"region":                    "cn-hangzhou",
+			cseKMSKeyIDConfigKey:        "key-id",
+			sseConfigKey:                "SSE-C",
+			sseCustomerKeyFileConfigKey: keyFile,
+		})
+		assert.ErrorContains(t, err, "client-side encryption cannot be combined with serverSideEncryption SSE-C")
+	})
+
+	t.Run("KMS key", func(t *testing.T) {
+		o := newObjectStore(newTestLogger())
+		require.NoError(t, o.Init(map[string]string{"region": "cn-hangzhou", cseKMSKeyIDConfigKey: "key-id"}))
+		wrapper, ok := o.client.(*ossClientWrapper)
+		require.True(t, ok)
+		assert.NotNil(t, wrapper.encryption)
+	})
+}
+
+func TestGetServerSideEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	keyFile := filepath.Join(t.TempDir(), "ssec.key")
+	require.NoError(t, os.WriteFile(keyFile, key, 0600))
+	encodedKeyFile := filepath.Join(t.TempDir(), "ssec.b64")
+	require.NoError(t, os.WriteFile(encodedKeyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	shortKeyFile := filepath.Join(t.TempDir(), "short.key")
+	require.NoError(t, os.WriteFile(shortKeyFile, []byte("short"), 0600))
+
+	tests := []struct {
+		name          string
+		config        map[string]string
+		envKeyID      string
+		expected      *serverSideEncryption
+		expectedError string
+	}{
+		{
+			name:   "no encryption",
+			config: map[string]string{},
+		},
+		{
+			name:     "KMS key from environment",
+			config:   map[string]string{},
+			envKeyID: "env-key",
+			expected: &serverSideEncryption{algorithm: "KMS", keyID: "env-key"},
+		},
+		{
+			name:     "KMS key from config takes precedence over environment",
+			config:   map[string]string{sseConfigKey: "KMS", sseKeyIDConfigKey: "bsl-key"},
+			envKeyID: "env-key",
+			expected: &serverSideEncryption{algorithm: "KMS", keyID: "bsl-key"},
+		},
+		{
+			name:     "KMS key ID implies KMS",
+			config:   map[string]string{sseKeyIDConfigKey: "bsl-key"},
+			expected: &serverSideEncryption{algorithm: "KMS", keyID: "bsl-key"},
+		},
+		{
+			name:     "KMS with OSS default key",
+			config:   map[string]string{sseConfigKey: "kms"},
+			expected: &serverSideEncryption{algorithm: "KMS"},
+		},
+		{
+			name:     "SSE-OSS",
+			config:   map[string]string{sseConfigKey: "AES256"},
+			envKeyID: "env-key",
+			expected: &serverSideEncryption{algorithm: "AES256"},
+		},
+		{
+			name:     "SSE-C with raw key",
+			config:   map[string]string{sseConfigKey: "SSE-C", sseCustomerKeyFileConfigKey: keyFile},
+			expected: &serverSideEncryption{customerKey: key},
+		},
+		{
+			name:     "SSE-C with base64 key",
+			config:   map[string]string{sseConfigKey: "SSE-C", sseCustomerKeyFileConfigKey: encodedKeyFile},
+			expected: &serverSideEncryption{customerKey: key},
+		},
+		{
+			name:          "SSE-C without key file",
+			config:        map[string]string{sseConfigKey: "SSE-C"},
+			expectedError: "config key serverSideEncryptionCustomerKeyFile is required",
+		},
+		{
+			name:          "SSE-C with invalid key",
+			config:        map[string]string{sseConfigKey: "SSE-C", sseCustomerKeyFileConfigKey: shortKeyFile},
+			expectedError: "must contain a 256-bit key",
+		},
+		{
+			name:          "key ID without KMS",
+			config:        map[string]string{sseConfigKey: "AES256", sseKeyIDConfigKey: "bsl-key"},
+			expectedError: "config key serverSideEncryptionKeyID requires serverSideEncryption to be KMS",
+		},
+		{
+			name:          "customer key file without SSE-C",
+			config:        map[string]string{sseCustomerKeyFileConfigKey: keyFile},
+			expectedError: "config key serverSideEncryptionCustomerKeyFile requires serverSideEncryption to be SSE-C",
+		},
+		{
+			name:          "unknown mode",
+			config:        map[string]string{sseConfigKey: "DES"},
+			expectedError: "invalid value \"DES\" for config key serverSideEncryption",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ALIBABA_CLOUD_ENCRYPTION_KEY_ID", tc.envKeyID)
+
+			sse, err := getServerSideEncryption(tc.config)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, sse)
+		})
+	}
+}
+
+func TestServerSideEncryptionCustomerKey(t *testing.T) {
+	server := newFakeOSSServer(t)
+	sse := &serverSideEncryption{customerKey: []byte("0123456789abcdef0123456789abcdef")}
+	headers := sse.headers()
+	assert.Equal(t, "AES256", headers[ossv2.HeaderOssSSECAlgorithm])
+	assert.Equal(t, "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", headers[ossv2.HeaderOssSSECKey])
+	assert.Equal(t, "hRasmdxgYDKV3nvbahU1MA==", headers[ossv2.HeaderOssSSECKeyMd5])
+
+	o := &ObjectStore{
+		log:                 newTestLogger(),
+		client:              &ossClientWrapper{client: server.newClient(), headers: headers},
+		sse:                 sse,
+		uploadPartSize:      ossv2.MinPartSize,
+		uploadConcurrency:   2,
+		downloadRangeSize:   ossv2.MinPartSize,
+		downloadConcurrency: 2,
+	}
+
+	data := newTestObject(int(3*ossv2.MinPartSize + 5))
+	require.NoError(t, o.PutObject("bucket", "key", bytes.NewReader(data)))
+	assert.Equal(t, headers[ossv2.HeaderOssSSECKey], server.objects["key"].customerKey)
+
+	exists, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	body, err := o.GetObject("bucket", "key")
+	require.NoError(t, err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Without the key, OSS refuses to read the object
+	_, err = (&ObjectStore{client: &ossClientWrapper{client: server.newClient()}}).ObjectExists("bucket", "key")
+	assert.Error(t, err)
+
+	result, err := o.client.Presign(context.Background(), &ossv2.GetObjectRequest{
+		Bucket: ossv2.Ptr("bucket"),
+		Key:    ossv2.Ptr("key"),
+	})
+	require.NoError(t, err)
+	signedHeaders := http.Header{}
+	for k, v := range result.SignedHeaders {
+		signedHeaders.Set(k, v)
+	}
+	for k, v := range headers {
+		assert.Equal(t, v, signedHeaders.Get(k), "%s should be signed", k)
+	}
+}
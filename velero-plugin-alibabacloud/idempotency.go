@@ -0,0 +1,93 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+)
+
+const (
+	// idempotencyKeyTagKey tags created snapshots with the key of the request
+	// that created them, so that a retried request finds them
+	idempotencyKeyTagKey = "alibabacloud.velero-plugin/idempotency-key"
+
+	// clientTokenWindow is how long a ClientToken is reused. ECS returns the
+	// resource created by an earlier request with the same token, even if it
+	// has been deleted since, for example with the backup it belonged to.
+	clientTokenWindow = time.Hour
+)
+
+// idempotencyKey returns the key of a request with the given parameters. The
+// order of tags does not matter.
+func idempotencyKey(id string, params []string, tags map[string]string) string {
+	parts := append([]string{id}, params...)
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		parts = append(parts, k+"="+tags[k])
+	}
+
+	hash := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// diskTagsMap returns the tags of a CreateDisk request as a map
+func diskTagsMap(tags []*ecs20140526.CreateDiskRequestTag) map[string]string {
+	result := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		result[tea.StringValue(tag.Key)] = tea.StringValue(tag.Value)
+	}
+	return result
+}
+
+// clientToken returns the ClientToken of the requests with key sent since
+// start. It is at most 64 ASCII characters, as required by ECS.
+func clientToken(key string, start time.Time) string {
+	return fmt.Sprintf("%s-%d", key, start.UnixNano())
+}
+
+// findSnapshot returns a snapshot of the volume created by an earlier request
+// with the same idempotency key that did not fail, or nil if there is none
+func (b *VolumeSnapshotter) findSnapshot(volumeID, key string) (*ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot, error) {
+	res, err := b.client.DescribeSnapshots(&ecs20140526.DescribeSnapshotsRequest{
+		RegionId: tea.String(b.region),
+		DiskId:   tea.String(volumeID),
+		Tag: []*ecs20140526.DescribeSnapshotsRequestTag{
+			{Key: tea.String(idempotencyKeyTagKey), Value: tea.String(key)},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up existing snapshots of volume %s", volumeID)
+	}
+	if res.Body == nil || res.Body.Snapshots == nil {
+		return nil, nil
+	}
+
+	for _, snapshot := range res.Body.Snapshots.Snapshot {
+		if snapshot != nil && tea.StringValue(snapshot.Status) != snapshotStatusFailed {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// hasSnapshotTag returns whether tags has the tag key=value
+func hasSnapshotTag(tags []*ecs20140526.CreateSnapshotRequestTag, key, value string) bool {
+	for _, tag := range tags {
+		if tea.StringValue(tag.Key) == key && tea.StringValue(tag.Value) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	tags := map[string]string{"velero.io/backup": "backup-1", "velero.io/pv": "pv-1"}
+	key := idempotencyKey("d-123456", nil, tags)
+
+	assert.Len(t, key, 32)
+	assert.Equal(t, key, idempotencyKey("d-123456", nil, map[string]string{"velero.io/pv": "pv-1", "velero.io/backup": "backup-1"}))
+	assert.NotEqual(t, key, idempotencyKey("d-789012", nil, tags))
+	assert.NotEqual(t, key, idempotencyKey("d-123456", nil, map[string]string{"velero.io/backup": "backup-2", "velero.io/pv": "pv-1"}))
+	assert.NotEqual(t, key, idempotencyKey("d-123456", []string{"cloud_essd"}, tags))
+	assert.NotEqual(t, idempotencyKey("d-1", []string{"23456"}, nil), idempotencyKey("d-123456", nil, nil))
+}
+
+func TestClientToken(t *testing.T) {
+	key := idempotencyKey("d-123456", nil, nil)
+	window := time.Now().Truncate(clientTokenWindow)
+
+	token := clientToken(key, window.Add(time.Second).Truncate(clientTokenWindow))
+	assert.LessOrEqual(t, len(token), 64)
+	assert.Equal(t, token, clientToken(key, window.Add(clientTokenWindow-time.Second).Truncate(clientTokenWindow)))
+	assert.NotEqual(t, token, clientToken(key, window.Add(clientTokenWindow).Truncate(clientTokenWindow)))
+}
+
+func TestIdempotencyKeyTagNotCopied(t *testing.T) {
+	b := &VolumeSnapshotter{log: newTestLogger()}
+
+	snapshotTags := b.getTags(map[string]string{"velero.io/backup": "backup-1"}, []*ecs20140526.DescribeDisksResponseBodyDisksDiskTagsTag{
+		{TagKey: tea.String(idempotencyKeyTagKey), TagValue: tea.String("key")},
+		{TagKey: tea.String("app"), TagValue: tea.String("db")},
+	})
+	assert.Len(t, snapshotTags, 2)
+	assert.False(t, hasSnapshotTag(snapshotTags, idempotencyKeyTagKey, "key"))
+
+	diskTags := b.getTagsForCluster([]*ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshotTagsTag{
+		{TagKey: tea.String(idempotencyKeyTagKey), TagValue: tea.String("key")},
+		{TagKey: tea.String("app"), TagValue: tea.String("db")},
+	})
+	assert.NotContains(t, diskTagsMap(diskTags), idempotencyKeyTagKey)
+	assert.Equal(t, "db", diskTagsMap(diskTags)["app"])
+}
+
+func TestCreateVolumeFromSnapshot_ClientToken(t *testing.T) {
+	client := new(mockECSClient)
+	defer client.AssertExpectations(t)
+
+	key := idempotencyKey("s-123456", []string{"cn-hangzhou-h", "cloud_essd", ""}, map[string]string{})
+	client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%")), nil)
+	client.On("CreateDisk", mock.MatchedBy(func(req *ecs20140526.CreateDiskRequest) bool {
+		return strings.HasPrefix(tea.StringValue(req.ClientToken), key+"-") && req.Tag == nil
+	})).Return(&ecs20140526.CreateDiskResponse{
+		Body: &ecs20140526.CreateDiskResponseBody{DiskId: tea.String("d-new")},
+	}, nil)
+	client.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-new", diskStatusAvailable), nil)
+
+	b := &VolumeSnapshotter{
+		log:                  newTestLogger(),
+		client:               client,
+		region:               "cn-hangzhou",
+		snapshotReadyTimeout: time.Minute,
+		diskReadyTimeout:     time.Minute,
+	}
+
+	volumeID, err := b.CreateVolumeFromSnapshot("s-123456", "cloud_essd", "cn-hangzhou-h", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "d-new", volumeID)
+}
+
+// newFakeECSVolumeSnapshotter returns a VolumeSnapshotter sending its requests
+// to server
+func newFakeECSVolumeSnapshotter(t *testing.T, server *fakeECSServer) *VolumeSnapshotter {
+	credentials := newCachedCredentialsProvider(newTestLogger(),
+		&ossCredentials{accessKeyID: "ak", accessKeySecret: "sk", expiration: time.Now().Add(time.Hour)},
+		func(ctx context.Context) (*ossCredentials, error) { return nil, errors.New("not refreshed") })
+	return &VolumeSnapshotter{
+		log:                  newTestLogger(),
+		region:               "cn-hangzhou",
+		client:               server.newClient(t, credentials),
+		snapshotReadyTimeout: time.Minute,
+		diskReadyTimeout:     time.Minute,
+	}
+}
+
+func TestCreateVolumeFromSnapshot_RetryAfterTimeout(t *testing.T) {
+	server := newFakeECSServer(t)
+	b := newFakeECSVolumeSnapshotter(t, server)
+
+	// ECS creates the disk, but the response is lost. The retry with the same
+	// ClientToken gets the same disk.
+	server.failCreateDisks = 1
+	volumeID, err := b.CreateVolumeFromSnapshot("s-1", "cloud_essd", "cn-hangzhou-h", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "d-new-1", volumeID)
+	assert.Equal(t, 1, server.createdDisks)
+}
+
+func TestCreateVolumeFromSnapshot_SeparateRestores(t *testing.T) {
+	server := newFakeECSServer(t)
+	b := newFakeECSVolumeSnapshotter(t, server)
+
+	// Two restores of the same snapshot get a disk each, even though nothing in
+	// their requests tells them apart
+	first, err := b.CreateVolumeFromSnapshot("s-1", "cloud_essd", "cn-hangzhou-h", nil)
+	require.NoError(t, err)
+	second, err := b.CreateVolumeFromSnapshot("s-1", "cloud_essd", "cn-hangzhou-h", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, 2, server.createdDisks)
+}
+
+func TestCreateSnapshot_RetryAfterCrash(t *testing.T) {
+	server := newFakeECSServer(t)
+	b := newFakeECSVolumeSnapshotter(t, server)
+
+	// A backup retried after the plugin crashed gets the snapshot created by the
+	// first attempt, another backup of the volume gets a new one
+	tags := map[string]string{"velero.io/backup": "backup-1", "velero.io/pv": "pv-1"}
+	first, err := b.CreateSnapshot("d-1", "cn-hangzhou-h", tags)
+	require.NoError(t, err)
+	retried, err := b.CreateSnapshot("d-1", "cn-hangzhou-h", tags)
+	require.NoError(t, err)
+	assert.Equal(t, first, retried)
+
+	other, err := b.CreateSnapshot("d-1", "cn-hangzhou-h", map[string]string{"velero.io/backup": "backup-2", "velero.io/pv": "pv-1"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, other)
+	assert.Equal(t, 2, server.created)
+}
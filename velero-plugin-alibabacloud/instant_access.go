@@ -0,0 +1,44 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxInstantAccessRetentionDays is the longest instant access retention accepted by ECS
+const maxInstantAccessRetentionDays = 65535
+
+// initInstantAccess reads the instant access settings of the snapshots created
+// by CreateSnapshot. Instant access is only supported for ESSD disks, ECS
+// rejects snapshots of other disks with it.
+func (b *VolumeSnapshotter) initInstantAccess(config map[string]string) error {
+	b.instantAccess = strings.EqualFold(config[instantAccessConfigKey], "true")
+
+	days, err := getConfigInt(config, instantAccessRetentionDaysConfigKey, 0)
+	if err != nil {
+		return err
+	}
+	if days > maxInstantAccessRetentionDays {
+		return errors.Errorf("invalid value %d for config key %s: must be at most %d",
+			days, instantAccessRetentionDaysConfigKey, maxInstantAccessRetentionDays)
+	}
+	if days > 0 && !b.instantAccess {
+		return errors.Errorf("config key %s requires %s to be true", instantAccessRetentionDaysConfigKey, instantAccessConfigKey)
+	}
+	b.instantAccessRetentionDays = days
+	return nil
+}
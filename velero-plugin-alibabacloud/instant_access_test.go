@@ -0,0 +1,160 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInitInstantAccess(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expectEnabled bool
+		expectDays    int
+		expectedError string
+	}{
+		{
+			name:   "disabled by default",
+			config: map[string]string{},
+		},
+		{
+			name:          "enabled",
+			config:        map[string]string{instantAccessConfigKey: "true"},
+			expectEnabled: true,
+		},
+		{
+			name:          "enabled with retention days",
+			config:        map[string]string{instantAccessConfigKey: "True", instantAccessRetentionDaysConfigKey: "7"},
+			expectEnabled: true,
+			expectDays:    7,
+		},
+		{
+			name:          "retention days without instant access",
+			config:        map[string]string{instantAccessRetentionDaysConfigKey: "7"},
+			expectedError: "config key instantAccessRetentionDays requires instantAccess to be true",
+		},
+		{
+			name:          "retention days too long",
+			config:        map[string]string{instantAccessConfigKey: "true", instantAccessRetentionDaysConfigKey: "65536"},
+			expectedError: "must be at most 65535",
+		},
+		{
+			name:          "invalid retention days",
+			config:        map[string]string{instantAccessConfigKey: "true", instantAccessRetentionDaysConfigKey: "0"},
+			expectedError: "invalid value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &VolumeSnapshotter{log: newTestLogger()}
+			err := b.initInstantAccess(test.config)
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectEnabled, b.instantAccess)
+			assert.Equal(t, test.expectDays, b.instantAccessRetentionDays)
+		})
+	}
+}
+
+func TestCreateSnapshot_InstantAccess(t *testing.T) {
+	tests := []struct {
+		name          string
+		instantAccess bool
+		days          int
+		expectDays    *int32
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:          "enabled",
+			instantAccess: true,
+		},
+		{
+			name:          "enabled with retention days",
+			instantAccess: true,
+			days:          3,
+			expectDays:    tea.Int32(3),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+
+			client.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-123456", diskStatusInUse), nil)
+			client.On("DescribeSnapshots", mock.Anything).Return(&ecs20140526.DescribeSnapshotsResponse{}, nil)
+			client.On("CreateSnapshot", mock.MatchedBy(func(req *ecs20140526.CreateSnapshotRequest) bool {
+				if !test.instantAccess {
+					return req.InstantAccess == nil && req.InstantAccessRetentionDays == nil
+				}
+				return tea.BoolValue(req.InstantAccess) && assert.ObjectsAreEqual(test.expectDays, req.InstantAccessRetentionDays)
+			})).Return(&ecs20140526.CreateSnapshotResponse{
+				Body: &ecs20140526.CreateSnapshotResponseBody{SnapshotId: tea.String("s-123456")},
+			}, nil)
+
+			b := &VolumeSnapshotter{
+				log:                        newTestLogger(),
+				client:                     client,
+				region:                     "cn-hangzhou",
+				instantAccess:              test.instantAccess,
+				instantAccessRetentionDays: test.days,
+			}
+
+			snapshotID, err := b.CreateSnapshot("d-123456", "cn-hangzhou-h", map[string]string{})
+			assert.NoError(t, err)
+			assert.Equal(t, "s-123456", snapshotID)
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshot_InstantAccess(t *testing.T) {
+	client := new(mockECSClient)
+	defer client.AssertExpectations(t)
+
+	// The snapshot is still being uploaded, but disks can be created from it
+	client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(instantAccessSnapshot("s-123456", "5%")), nil).Once()
+	client.On("CreateDisk", mock.MatchedBy(func(req *ecs20140526.CreateDiskRequest) bool {
+		return tea.StringValue(req.SnapshotId) == "s-123456"
+	})).Return(&ecs20140526.CreateDiskResponse{
+		Body: &ecs20140526.CreateDiskResponseBody{DiskId: tea.String("d-123456")},
+	}, nil)
+	client.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-123456", diskStatusAvailable), nil)
+
+	b := &VolumeSnapshotter{
+		log:                  newTestLogger(),
+		client:               client,
+		region:               "cn-hangzhou",
+		snapshotReadyTimeout: time.Minute,
+		snapshotPollInterval: time.Hour,
+		diskReadyTimeout:     time.Minute,
+	}
+
+	volumeID, err := b.CreateVolumeFromSnapshot("s-123456", "cloud_essd", "cn-hangzhou-h", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "d-123456", volumeID)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"maps"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mirrorFailurePolicyFail fails PutObject and DeleteObject when the mirror bucket fails
+	mirrorFailurePolicyFail = "fail"
+	// mirrorFailurePolicyLog only logs failures of the mirror bucket
+	mirrorFailurePolicyLog = "log"
+)
+
+// mirrorConfigKeys are the config keys of the mirror bucket
+var mirrorConfigKeys = []string{
+	mirrorBucketConfigKey,
+	mirrorRegionConfigKey,
+	mirrorEndpointConfigKey,
+	mirrorCredentialsFileConfigKey,
+	mirrorFailurePolicyConfigKey,
+}
+
+// primaryOnlyConfigKeys are the config keys that locate the primary bucket, and
+// do not apply to a secondary bucket in another region
+var primaryOnlyConfigKeys = []string{
+	ossRegionConfigKey,
+	networkTypeConfigKey,
+	endpointConfigKey,
+	publicEndpointConfigKey,
+}
+
+// roleConfigKeys are the config keys of the role assumed with the credentials of
+// the location, which do not apply to a secondary bucket with its own credentials
+var roleConfigKeys = []string{
+	roleArnConfigKey,
+	roleSessionNameConfigKey,
+	externalIDConfigKey,
+	oidcRoleArnConfigKey,
+	oidcProviderArnConfigKey,
+	oidcTokenFileConfigKey,
+	stsEndpointConfigKey,
+}
+
+// mirror is a secondary bucket that every object written to or deleted from the
+// primary bucket is written to or deleted from as well
+type mirror struct {
+	log         logrus.FieldLogger
+	store       *ObjectStore
+	bucket      string
+	failOnError bool // Whether a failure of the mirror bucket fails the operation
+}
+
+// secondaryConfig returns the config of a secondary bucket. The settings that
+// locate the primary bucket are replaced by the given ones, empty ones being
+// found the same way as for the primary bucket. A secondary bucket with its own
+// credentials file does not assume the role of the primary bucket. Other settings, such as
+// encryption, retries and WORM retention, apply to both buckets.
+func secondaryConfig(config map[string]string, bucket, region, endpoint, credentialsFile string) map[string]string {
+	secondary := maps.Clone(config)
+	for _, key := range primaryOnlyConfigKeys {
+		delete(secondary, key)
+	}
+	for _, key := range mirrorConfigKeys {
+		delete(secondary, key)
+	}
+	for _, key := range replicaConfigKeys {
+		delete(secondary, key)
+	}
+
+	secondary["bucket"] = bucket
+	if region != "" {
+		secondary[ossRegionConfigKey] = region
+	}
+	if endpoint != "" {
+		secondary[endpointConfigKey] = endpoint
+	}
+	if credentialsFile != "" {
+		secondary[credFileConfigKey] = credentialsFile
+		for _, key := range roleConfigKeys {
+			delete(secondary, key)
+		}
+	}
+	return secondary
+}
+
+// newMirror creates the mirror bucket configured by the mirror config keys, or
+// returns nil when mirroring is not configured
+func newMirror(log logrus.FieldLogger, config map[string]string) (*mirror, error) {
+	bucket := config[mirrorBucketConfigKey]
+	if bucket == "" {
+		for _, key := range mirrorConfigKeys {
+			if config[key] != "" {
+				return nil, errors.Errorf("config key %s requires %s", key, mirrorBucketConfigKey)
+			}
+		}
+		return nil, nil
+	}
+
+	var failOnError bool
+	switch policy := config[mirrorFailurePolicyConfigKey]; policy {
+	case "", mirrorFailurePolicyFail:
+		failOnError = true
+	case mirrorFailurePolicyLog:
+	default:
+		return nil, errors.Errorf("invalid value %s for config key %s: must be %s or %s",
+			policy, mirrorFailurePolicyConfigKey, mirrorFailurePolicyFail, mirrorFailurePolicyLog)
+	}
+
+	log = log.WithField("mirrorBucket", bucket)
+	store := newObjectStore(log)
+	if err := store.Init(secondaryConfig(config, bucket, config[mirrorRegionConfigKey],
+		config[mirrorEndpointConfigKey], config[mirrorCredentialsFileConfigKey])); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize mirror bucket %s", bucket)
+	}
+	return &mirror{log: log, store: store, bucket: bucket, failOnError: failOnError}, nil
+}
+
+// putObject writes the object to the primary bucket with put, while streaming
+// the same bytes to the mirror bucket
+func (m *mirror) putObject(key string, body io.Reader, put func(body io.Reader) error) error {
+	pipeReader, pipeWriter := io.Pipe()
+	mirrored := make(chan error, 1)
+	go func() {
+		err := m.store.PutObject(m.bucket, key, pipeReader)
+		// Unblock the primary upload if the mirror upload stopped reading early
+		pipeReader.CloseWithError(errors.New("mirror upload stopped"))
+		mirrored <- err
+	}()
+
+	err := put(io.TeeReader(body, &mirrorWriter{pipe: pipeWriter}))
+	if err != nil {
+		pipeWriter.CloseWithError(err)
+	} else {
+		pipeWriter.Close()
+	}
+	mirrorErr := <-mirrored
+	if err != nil {
+		return err
+	}
+	return m.result(mirrorErr, "put object "+key)
+}
+
+// deleteObject deletes the object from the mirror bucket
+func (m *mirror) deleteObject(key string) error {
+	return m.result(m.store.DeleteObject(m.bucket, key), "delete object "+key)
+}
+
+// result applies the failure policy to the error of the mirror bucket
+func (m *mirror) result(err error, action string) error {
+	if err == nil {
+		return nil
+	}
+	if m.failOnError {
+		return errors.Wrapf(err, "failed to %s in mirror bucket %s", action, m.bucket)
+	}
+	m.log.Warnf("failed to %s in mirror bucket %s, ignoring because %s is %s: %v",
+		action, m.bucket, mirrorFailurePolicyConfigKey, mirrorFailurePolicyLog, err)
+	return nil
+}
+
+// mirrorWriter passes the bytes read by the primary upload on to the mirror
+// upload. Once the mirror upload fails the bytes are dropped, so that the
+// primary upload carries on.
+type mirrorWriter struct {
+	pipe   *io.PipeWriter
+	failed bool
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		if _, err := w.pipe.Write(p); err != nil {
+			w.failed = true
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondaryConfig(t *testing.T) {
+	config := map[string]string{
+		"bucket":                       "primary",
+		"prefix":                       "backups",
+		regionConfigKey:                "cn-beijing",
+		ossRegionConfigKey:             "cn-beijing",
+		endpointConfigKey:              "https://oss-cn-beijing-internal.aliyuncs.com",
+		networkTypeConfigKey:           networkTypeInternal,
+		credFileConfigKey:              "/credentials/primary",
+		sseConfigKey:                   "KMS",
+		mirrorBucketConfigKey:          "mirror",
+		mirrorRegionConfigKey:          "cn-shanghai",
+		mirrorFailurePolicyConfigKey:   mirrorFailurePolicyLog,
+		mirrorCredentialsFileConfigKey: "/credentials/mirror",
+		roleArnConfigKey:               "acs:ram::123:role/primary",
+		oidcTokenFileConfigKey:         "/var/run/secrets/token",
+		stsEndpointConfigKey:           "sts-vpc.cn-beijing.aliyuncs.com",
+	}
+
+	// A mirror with its own credentials does not assume the role of the primary bucket
+	assert.Equal(t, map[string]string{
+		"bucket":           "mirror",
+		"prefix":           "backups",
+		regionConfigKey:    "cn-beijing",
+		ossRegionConfigKey: "cn-shanghai",
+		credFileConfigKey:  "/credentials/mirror",
+		sseConfigKey:       "KMS",
+	}, secondaryConfig(config, "mirror", "cn-shanghai", "", "/credentials/mirror"))
+
+	assert.Equal(t, map[string]string{
+		"bucket":               "mirror",
+		"prefix":               "backups",
+		regionConfigKey:        "cn-beijing",
+		endpointConfigKey:      "https://oss-cn-shanghai.aliyuncs.com",
+		credFileConfigKey:      "/credentials/primary",
+		sseConfigKey:           "KMS",
+		roleArnConfigKey:       "acs:ram::123:role/primary",
+		oidcTokenFileConfigKey: "/var/run/secrets/token",
+		stsEndpointConfigKey:   "sts-vpc.cn-beijing.aliyuncs.com",
+	}, secondaryConfig(config, "mirror", "", "https://oss-cn-shanghai.aliyuncs.com", ""))
+
+	// The config of the primary bucket is left unchanged
+	assert.Equal(t, "primary", config["bucket"])
+	assert.Equal(t, "cn-beijing", config[ossRegionConfigKey])
+}
+
+func TestNewMirror(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+
+	m, err := newMirror(newTestLogger(), map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	_, err = newMirror(newTestLogger(), map[string]string{mirrorRegionConfigKey: "cn-shanghai"})
+	assert.EqualError(t, err, "config key mirrorRegion requires mirrorBucket")
+
+	_, err = newMirror(newTestLogger(), map[string]string{mirrorBucketConfigKey: "mirror", mirrorFailurePolicyConfigKey: "retry"})
+	assert.EqualError(t, err, "invalid value retry for config key mirrorFailurePolicy: must be fail or log")
+
+	m, err = newMirror(newTestLogger(), map[string]string{
+		regionConfigKey:       "cn-beijing",
+		notOnECSConfigKey:     "true",
+		mirrorBucketConfigKey: "mirror",
+		mirrorRegionConfigKey: "cn-shanghai",
+	})
+	require.NoError(t, err)
+	assert.True(t, m.failOnError)
+	assert.Equal(t, "mirror", m.bucket)
+	assert.Equal(t, "cn-shanghai", m.store.region)
+	assert.Equal(t, "https://oss-cn-shanghai.aliyuncs.com", m.store.endpoint)
+	assert.Nil(t, m.store.mirror)
+}
+
+// recordingOSSClient records the bodies uploaded to it, by part number
+type recordingOSSClient struct {
+	*mockOSSClient
+
+	mu    sync.Mutex
+	parts map[int32][]byte
+}
+
+func (c *recordingOSSClient) PutObject(ctx context.Context, request *ossv2.PutObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.PutObjectResult, error) {
+	if err := c.record(0, request.Body); err != nil {
+		return nil, err
+	}
+	return c.mockOSSClient.PutObject(ctx, request, optFns...)
+}
+
+func (c *recordingOSSClient) UploadPart(ctx context.Context, request *ossv2.UploadPartRequest, optFns ...func(*ossv2.Options)) (*ossv2.UploadPartResult, error) {
+	if err := c.record(request.PartNumber, request.Body); err != nil {
+		return nil, err
+	}
+	return c.mockOSSClient.UploadPart(ctx, request, optFns...)
+}
+
+func (c *recordingOSSClient) record(partNumber int32, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.parts == nil {
+		c.parts = map[int32][]byte{}
+	}
+	c.parts[partNumber] = data
+	return nil
+}
+
+// uploaded returns the uploaded object
+func (c *recordingOSSClient) uploaded() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var object []byte
+	for _, partNumber := range slices.Sorted(maps.Keys(c.parts)) {
+		object = append(object, c.parts[partNumber]...)
+	}
+	return object
+}
+
+func TestMirror_PutObject(t *testing.T) {
+	partSize := ossv2.MinPartSize
+	mirrorFailed := &ossv2.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"}
+
+	tests := []struct {
+		name           string
+		bodySize       int64
+		failOnError    bool
+		primaryErr     error
+		mirrorErr      error
+		expectedError  string
+		expectMirrored bool
+	}{
+		{
+			name:           "object is written to both buckets",
+			bodySize:       partSize - 1,
+			failOnError:    true,
+			expectMirrored: true,
+		},
+		{
+			name:           "multipart object is written to both buckets",
+			bodySize:       partSize*2 + 1,
+			failOnError:    true,
+			expectMirrored: true,
+		},
+		{
+			name:          "mirror failure fails the upload",
+			bodySize:      partSize - 1,
+			failOnError:   true,
+			mirrorErr:     mirrorFailed,
+			expectedError: "failed to put object key in mirror bucket mirror",
+		},
+		{
+			name:      "mirror failure is only logged",
+			bodySize:  partSize - 1,
+			mirrorErr: mirrorFailed,
+		},
+		{
+			name:      "failed multipart mirror upload does not stall the primary upload",
+			bodySize:  partSize*3 + 1,
+			mirrorErr: mirrorFailed,
+		},
+		{
+			name:          "primary failure fails the upload",
+			bodySize:      partSize - 1,
+			primaryErr:    errors.New("connection reset"),
+			expectedError: "connection reset",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newClient := func(err error) *recordingOSSClient {
+				client := &recordingOSSClient{mockOSSClient: new(mockOSSClient)}
+				client.On("PutObject", mock.Anything, mock.Anything).Return(&ossv2.PutObjectResult{}, err)
+				client.On("InitiateMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.InitiateMultipartUploadResult{UploadId: ossv2.Ptr("upload-id")}, nil)
+				if err != nil {
+					client.On("UploadPart", mock.Anything, mock.Anything).Return(nil, err)
+				} else {
+					client.On("UploadPart", mock.Anything, mock.Anything).Return(&ossv2.UploadPartResult{ETag: ossv2.Ptr("etag")}, nil)
+				}
+				client.On("CompleteMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.CompleteMultipartUploadResult{}, nil)
+				client.On("AbortMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.AbortMultipartUploadResult{}, nil)
+				return client
+			}
+			primaryClient, mirrorClient := newClient(tc.primaryErr), newClient(tc.mirrorErr)
+
+			o := &ObjectStore{
+				log:               newTestLogger(),
+				client:            primaryClient,
+				uploadPartSize:    partSize,
+				uploadConcurrency: 2,
+				mirror: &mirror{
+					log: newTestLogger(),
+					store: &ObjectStore{
+						log:               newTestLogger(),
+						client:            mirrorClient,
+						uploadPartSize:    partSize,
+						uploadConcurrency: 2,
+					},
+					bucket:      "mirror",
+					failOnError: tc.failOnError,
+				},
+			}
+
+			body := newTestObject(int(tc.bodySize))
+			err := o.PutObject("primary", "key", bytes.NewReader(body))
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(body, primaryClient.uploaded()))
+			if tc.expectMirrored {
+				assert.True(t, bytes.Equal(body, mirrorClient.uploaded()))
+			}
+		})
+	}
+}
+
+func TestMirror_DeleteObject(t *testing.T) {
+	tests := []struct {
+		name          string
+		failOnError   bool
+		primaryErr    error
+		mirrorErr     error
+		expectedError string
+	}{
+		{
+			name:        "object is deleted from both buckets",
+			failOnError: true,
+		},
+		{
+			name:          "mirror failure fails the delete",
+			failOnError:   true,
+			mirrorErr:     errors.New("connection refused"),
+			expectedError: "failed to delete object key in mirror bucket mirror",
+		},
+		{
+			name:      "mirror failure is only logged",
+			mirrorErr: errors.New("connection refused"),
+		},
+		{
+			name:          "primary failure fails the delete",
+			primaryErr:    errors.New("connection reset"),
+			expectedError: "failed to delete object key from bucket primary",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryClient, mirrorClient := new(mockOSSClient), new(mockOSSClient)
+			primaryClient.On("DeleteObject", mock.Anything, mock.MatchedBy(func(req *ossv2.DeleteObjectRequest) bool {
+				return ossv2.ToString(req.Bucket) == "primary" && ossv2.ToString(req.Key) == "key"
+			})).Return(&ossv2.DeleteObjectResult{}, tc.primaryErr)
+			mirrorClient.On("DeleteObject", mock.Anything, mock.MatchedBy(func(req *ossv2.DeleteObjectRequest) bool {
+				return ossv2.ToString(req.Bucket) == "mirror" && ossv2.ToString(req.Key) == "key"
+			})).Return(&ossv2.DeleteObjectResult{}, tc.mirrorErr)
+
+			o := &ObjectStore{
+				log:    newTestLogger(),
+				client: primaryClient,
+				mirror: &mirror{
+					log:         newTestLogger(),
+					store:       &ObjectStore{log: newTestLogger(), client: mirrorClient},
+					bucket:      "mirror",
+					failOnError: tc.failOnError,
+				},
+			}
+
+			err := o.DeleteObject("primary", "key")
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			mirrorClient.AssertCalled(t, "DeleteObject", mock.Anything, mock.Anything)
+		})
+	}
+}
@@ -14,9 +14,11 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"hash/crc64"
 	"io"
-	"os"
+	"strings"
 	"time"
 
 	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
@@ -36,22 +38,70 @@ type ossClientInterface interface {
 	ListObjectsV2(ctx context.Context, request *ossv2.ListObjectsV2Request, optFns ...func(*ossv2.Options)) (*ossv2.ListObjectsV2Result, error)
 	DeleteObject(ctx context.Context, request *ossv2.DeleteObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.DeleteObjectResult, error)
 	Presign(ctx context.Context, request any, optFns ...func(*ossv2.PresignOptions)) (*ossv2.PresignResult, error)
+	RestoreObject(ctx context.Context, request *ossv2.RestoreObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.RestoreObjectResult, error)
+	GetBucketLocation(ctx context.Context, request *ossv2.GetBucketLocationRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketLocationResult, error)
+	GetBucketInfo(ctx context.Context, request *ossv2.GetBucketInfoRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketInfoResult, error)
+
+	// Bucket WORM retention policy operations
+	GetBucketWorm(ctx context.Context, request *ossv2.GetBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketWormResult, error)
+	InitiateBucketWorm(ctx context.Context, request *ossv2.InitiateBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateBucketWormResult, error)
+	CompleteBucketWorm(ctx context.Context, request *ossv2.CompleteBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteBucketWormResult, error)
+	ExtendBucketWorm(ctx context.Context, request *ossv2.ExtendBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.ExtendBucketWormResult, error)
+
+	// Multipart operations, used by ossv2.Uploader for large objects
+	InitiateMultipartUpload(ctx context.Context, request *ossv2.InitiateMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateMultipartUploadResult, error)
+	UploadPart(ctx context.Context, request *ossv2.UploadPartRequest, optFns ...func(*ossv2.Options)) (*ossv2.UploadPartResult, error)
+	CompleteMultipartUpload(ctx context.Context, request *ossv2.CompleteMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteMultipartUploadResult, error)
+	AbortMultipartUpload(ctx context.Context, request *ossv2.AbortMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.AbortMultipartUploadResult, error)
+	ListParts(ctx context.Context, request *ossv2.ListPartsRequest, optFns ...func(*ossv2.Options)) (*ossv2.ListPartsResult, error)
 }
 
 // ossClientWrapper wraps ossv2.Client to implement ossClientInterface
+// When client-side encryption is enabled, object reads and writes go through
+// the encryption client, which encrypts and decrypts transparently.
+// headers are added to every request that reads or writes object data, and
+// carry the SSE-C key when it is configured.
 type ossClientWrapper struct {
-	client *ossv2.Client
+	client     *ossv2.Client
+	encryption *ossv2.EncryptionClient
+	headers    map[string]string
+	presigner  *ossv2.Client // Signs URLs for the public endpoint, nil to use client
+}
+
+// addHeaders adds the wrapper headers to a request
+func (w *ossClientWrapper) addHeaders(request *ossv2.RequestCommon) {
+	if len(w.headers) == 0 {
+		return
+	}
+	if request.Headers == nil {
+		request.Headers = make(map[string]string, len(w.headers))
+	}
+	for k, v := range w.headers {
+		request.Headers[k] = v
+	}
 }
 
 func (w *ossClientWrapper) PutObject(ctx context.Context, request *ossv2.PutObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.PutObjectResult, error) {
+	w.addHeaders(&request.RequestCommon)
+	if w.encryption != nil {
+		return w.encryption.PutObject(ctx, request, optFns...)
+	}
 	return w.client.PutObject(ctx, request, optFns...)
 }
 
 func (w *ossClientWrapper) HeadObject(ctx context.Context, request *ossv2.HeadObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.HeadObjectResult, error) {
+	w.addHeaders(&request.RequestCommon)
+	if w.encryption != nil {
+		return w.encryption.HeadObject(ctx, request, optFns...)
+	}
 	return w.client.HeadObject(ctx, request, optFns...)
 }
 
 func (w *ossClientWrapper) GetObject(ctx context.Context, request *ossv2.GetObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetObjectResult, error) {
+	w.addHeaders(&request.RequestCommon)
+	if w.encryption != nil {
+		return w.encryption.GetObject(ctx, request, optFns...)
+	}
 	return w.client.GetObject(ctx, request, optFns...)
 }
 
@@ -64,18 +114,130 @@ func (w *ossClientWrapper) DeleteObject(ctx context.Context, request *ossv2.Dele
 }
 
 func (w *ossClientWrapper) Presign(ctx context.Context, request any, optFns ...func(*ossv2.PresignOptions)) (*ossv2.PresignResult, error) {
+	if r, ok := request.(*ossv2.GetObjectRequest); ok {
+		w.addHeaders(&r.RequestCommon)
+	}
+	if w.presigner != nil {
+		return w.presigner.Presign(ctx, request, optFns...)
+	}
 	return w.client.Presign(ctx, request, optFns...)
 }
 
-// ObjectStore represents an object storage entity
+func (w *ossClientWrapper) RestoreObject(ctx context.Context, request *ossv2.RestoreObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.RestoreObjectResult, error) {
+	return w.client.RestoreObject(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) GetBucketLocation(ctx context.Context, request *ossv2.GetBucketLocationRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketLocationResult, error) {
+	return w.client.GetBucketLocation(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) GetBucketInfo(ctx context.Context, request *ossv2.GetBucketInfoRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketInfoResult, error) {
+	return w.client.GetBucketInfo(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) GetBucketWorm(ctx context.Context, request *ossv2.GetBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketWormResult, error) {
+	return w.client.GetBucketWorm(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) InitiateBucketWorm(ctx context.Context, request *ossv2.InitiateBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateBucketWormResult, error) {
+	return w.client.InitiateBucketWorm(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) CompleteBucketWorm(ctx context.Context, request *ossv2.CompleteBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteBucketWormResult, error) {
+	return w.client.CompleteBucketWorm(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) ExtendBucketWorm(ctx context.Context, request *ossv2.ExtendBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.ExtendBucketWormResult, error) {
+	return w.client.ExtendBucketWorm(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) InitiateMultipartUpload(ctx context.Context, request *ossv2.InitiateMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateMultipartUploadResult, error) {
+	w.addHeaders(&request.RequestCommon)
+	if w.encryption != nil {
+		return w.encryption.InitiateMultipartUpload(ctx, request, optFns...)
+	}
+	return w.client.InitiateMultipartUpload(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) UploadPart(ctx context.Context, request *ossv2.UploadPartRequest, optFns ...func(*ossv2.Options)) (*ossv2.UploadPartResult, error) {
+	w.addHeaders(&request.RequestCommon)
+	if w.encryption != nil {
+		return w.encryption.UploadPart(ctx, request, optFns...)
+	}
+	return w.client.UploadPart(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) CompleteMultipartUpload(ctx context.Context, request *ossv2.CompleteMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteMultipartUploadResult, error) {
+	if w.encryption != nil {
+		return w.encryption.CompleteMultipartUpload(ctx, request, optFns...)
+	}
+	return w.client.CompleteMultipartUpload(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) AbortMultipartUpload(ctx context.Context, request *ossv2.AbortMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.AbortMultipartUploadResult, error) {
+	if w.encryption != nil {
+		return w.encryption.AbortMultipartUpload(ctx, request, optFns...)
+	}
+	return w.client.AbortMultipartUpload(ctx, request, optFns...)
+}
+
+func (w *ossClientWrapper) ListParts(ctx context.Context, request *ossv2.ListPartsRequest, optFns ...func(*ossv2.Options)) (*ossv2.ListPartsResult, error) {
+	if w.encryption != nil {
+		return w.encryption.ListParts(ctx, request, optFns...)
+	}
+	return w.client.ListParts(ctx, request, optFns...)
+}
+
+// uploadClient returns the client used by the multipart uploader. The uploader
+// only sets up client-side encryption of parts when it is given the SDK's
+// encryption client itself, so that is unwrapped when enabled.
+func uploadClient(client ossClientInterface) ossv2.UploadAPIClient {
+	if w, ok := client.(*ossClientWrapper); ok && w.encryption != nil {
+		return w.encryption
+	}
+	return client
+}
+
+// defaultUploadPartSize is the part size used for multipart uploads when
+// uploadPartSize is not configured. The size of a streamed body is unknown up
+// front, so together with the 10,000 parts limit of OSS this caps a single
+// object at roughly 156 GiB.
+const defaultUploadPartSize = 16 * 1024 * 1024
+
+// ObjectStore represents an object storage entity.
+// Its methods may be called concurrently once Init returns. The clients are
+// created by Init and never replaced, refreshed credentials are picked up on
+// every request through the shared credentialsProvider.
 type ObjectStore struct {
-	log             logrus.FieldLogger
-	client          ossClientInterface
-	encryptionKeyID string
-	ramRole         string
-	endpoint        string
-	region          string
-	rawClient       *ossv2.Client // Keep raw client for updateOssClient
+	log         logrus.FieldLogger
+	client      ossClientInterface
+	credentials *credentialsProvider // Cached credentials shared by the OSS and KMS clients
+	sse         *serverSideEncryption
+	endpoint    string
+	region      string
+
+	publicEndpoint string // Endpoint or custom domain of signed URLs, empty to use endpoint
+
+	uploadPartSize    int64 // Bodies larger than this are uploaded in parts
+	uploadConcurrency int   // Number of parts uploaded in parallel
+
+	downloadRangeSize   int64 // Size of each byte range fetched by GetObject
+	downloadConcurrency int   // Number of byte ranges fetched in parallel
+
+	uploadBandwidthLimit   int64 // Bytes per second sent to OSS by all requests, 0 for no limit
+	downloadBandwidthLimit int64 // Bytes per second received from OSS by all requests, 0 for no limit
+
+	cseKeyFile  string // RSA private key file for client-side encryption
+	cseKMSKeyID string // KMS key ID for client-side encryption
+
+	storageClass        ossv2.StorageClassType // Storage class of uploaded objects, empty for the bucket default
+	restoreTimeout      time.Duration          // How long GetObject waits for archived backup contents to be restored
+	restorePollInterval time.Duration          // How often the restore status is checked
+
+	retry *retryPolicy // Retries and timeouts of the OSS requests
+
+	mirror  *mirror  // Secondary bucket objects are written to as well, nil without mirroring
+	replica *replica // Copy of the bucket read when it is unavailable, nil without a replica
 }
 
 // newObjectStore init ObjectStore
@@ -95,69 +257,240 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		return errors.Wrapf(err, "failed to validate object store config keys")
 	}
 
-	region := getEcsRegionID(config)
+	ecsRegion := getEcsRegionID(config)
+	region := getOssRegionID(config)
+	if region == "" {
+		region = ecsRegion
+	}
 	if region == "" {
 		region = DefaultRegion
 	}
 	o.region = region
 
 	o.endpoint = getOssEndpoint(region, config)
-	o.encryptionKeyID = os.Getenv("ALIBABA_CLOUD_ENCRYPTION_KEY_ID")
+	if config[ossRegionConfigKey] != "" && config[endpointConfigKey] == "" {
+		var reason string
+		o.endpoint, reason = selectOssEndpoint(region, ecsRegion, config)
+		o.log.Infof("using endpoint %s for %s %s because %s", o.endpoint, ossRegionConfigKey, region, reason)
+	}
+	o.publicEndpoint = config[publicEndpointConfigKey]
+
+	sse, err := getServerSideEncryption(config)
+	if err != nil {
+		return err
+	}
+	o.sse = sse
+
+	o.storageClass, err = getStorageClass(config)
+	if err != nil {
+		return err
+	}
+
+	o.restoreTimeout, err = getConfigDuration(config, restoreTimeoutConfigKey, defaultRestoreTimeout)
+	if err != nil {
+		return err
+	}
+	o.restorePollInterval = defaultRestorePollInterval
+
+	partSize, err := getConfigSize(config, uploadPartSizeConfigKey, defaultUploadPartSize)
+	if err != nil {
+		return err
+	}
+	if partSize < ossv2.MinPartSize || partSize > ossv2.MaxPartSize {
+		return errors.Errorf("invalid value %d for config key %s: must be between %d and %d bytes",
+			partSize, uploadPartSizeConfigKey, ossv2.MinPartSize, ossv2.MaxPartSize)
+	}
+	o.uploadPartSize = partSize
+
+	o.uploadConcurrency, err = getConfigInt(config, uploadConcurrencyConfigKey, ossv2.DefaultUploadParallel)
+	if err != nil {
+		return err
+	}
+
+	o.downloadRangeSize, err = getConfigSize(config, downloadRangeSizeConfigKey, defaultDownloadRangeSize)
+	if err != nil {
+		return err
+	}
+
+	o.downloadConcurrency, err = getConfigInt(config, downloadConcurrencyConfigKey, ossv2.DefaultDownloadParallel)
+	if err != nil {
+		return err
+	}
+
+	o.uploadBandwidthLimit, err = getConfigSize(config, uploadBandwidthLimitConfigKey, 0)
+	if err != nil {
+		return err
+	}
 
-	cred, err := getCredentials(config)
+	o.downloadBandwidthLimit, err = getConfigSize(config, downloadBandwidthLimitConfigKey, 0)
+	if err != nil {
+		return err
+	}
+
+	o.cseKeyFile = config[cseKeyFileConfigKey]
+	o.cseKMSKeyID = config[cseKMSKeyIDConfigKey]
+	if o.cseKeyFile != "" || o.cseKMSKeyID != "" {
+		// The uploader sends encrypted parts through the SDK encryption client,
+		// which cannot add the SSE-C headers
+		if len(o.sse.headers()) > 0 {
+			return errors.Errorf("client-side encryption cannot be combined with %s %s", sseConfigKey, sseModeCustomer)
+		}
+		// Encrypted parts must start on a cipher block boundary
+		if partSize%16 != 0 {
+			return errors.Errorf("invalid value %d for config key %s: must be a multiple of 16 bytes with client-side encryption",
+				partSize, uploadPartSizeConfigKey)
+		}
+	}
+
+	o.retry, err = getRetryPolicy(config)
+	if err != nil {
+		return err
+	}
+
+	o.credentials, err = newCredentialsProviderFromConfig(o.log, config)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get credentials")
 	}
 
-	o.ramRole = cred.ramRole
-	rawClient, err := o.getOssClient(cred)
+	rawClient, err := o.getOssClient()
 	if err != nil {
 		return errors.Wrapf(err, "failed to create OSS client")
 	}
 
-	o.rawClient = rawClient
-	o.client = &ossClientWrapper{client: rawClient}
-	return nil
+	// Without an explicit endpoint or OSS region, the endpoint is selected for the
+	// region of the bucket
+	if bucket := config["bucket"]; bucket != "" && config[endpointConfigKey] == "" && config[ossRegionConfigKey] == "" {
+		if o.discoverBucketEndpoint(&ossClientWrapper{client: rawClient}, bucket, ecsRegion, config) {
+			if rawClient, err = o.getOssClient(); err != nil {
+				return errors.Wrapf(err, "failed to create OSS client")
+			}
+		}
+	}
+
+	o.client, err = o.wrapOssClient(rawClient)
+	if err != nil {
+		return err
+	}
+
+	wormDays, err := getConfigInt(config, wormRetentionDaysConfigKey, 0)
+	if err != nil {
+		return err
+	}
+	if wormDays > 0 {
+		bucket := config["bucket"]
+		if bucket == "" {
+			return errors.Errorf("config key %s requires the bucket of the backup storage location", wormRetentionDaysConfigKey)
+		}
+		configure := strings.EqualFold(config[wormConfigurePolicyConfigKey], "true")
+		ctx, cancel := o.retry.requestContext()
+		defer cancel()
+		if err := o.ensureWormPolicy(ctx, bucket, int32(wormDays), configure); err != nil {
+			return err
+		}
+	}
+	if strings.EqualFold(config[preflightCheckConfigKey], "true") {
+		bucket := config["bucket"]
+		if bucket == "" {
+			return errors.Errorf("config key %s requires the bucket of the backup storage location", preflightCheckConfigKey)
+		}
+		if err := o.preflight(bucket, config["prefix"], wormDays > 0); err != nil {
+			return err
+		}
+	}
+
+	o.mirror, err = newMirror(o.log, config)
+	if err != nil {
+		return err
+	}
+
+	o.replica, err = newReplica(o.log, config)
+	return err
 }
 
 // PutObject creates a new object using the data in body within the specified
 // object storage bucket with the given key.
+// Bodies up to uploadPartSize are sent with a single PutObject request, larger
+// ones are uploaded in parts in parallel. A failed multipart upload is aborted.
+// The CRC64 of the body is computed while it is streamed and compared with the
+// one OSS computed for the stored object.
+// With a mirror bucket the body is streamed to both buckets at once.
 func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return errors.Wrapf(err, "failed to update OSS client for putting object %s", key)
+	if o.mirror != nil {
+		return o.mirror.putObject(key, body, func(body io.Reader) error {
+			return o.putObject(bucket, key, body)
+		})
 	}
+	return o.putObject(bucket, key, body)
+}
 
-	ctx := context.Background()
+// putObject uploads the object to the primary bucket
+func (o *ObjectStore) putObject(bucket, key string, body io.Reader) error {
+	ctx, cancel := o.retry.transferContext()
+	defer cancel()
 	request := &ossv2.PutObjectRequest{
-		Bucket: ossv2.Ptr(bucket),
-		Key:    ossv2.Ptr(key),
-		Body:   body,
+		Bucket:       ossv2.Ptr(bucket),
+		Key:          ossv2.Ptr(key),
+		StorageClass: o.objectStorageClass(key),
 	}
 
-	if o.encryptionKeyID != "" {
-		request.ServerSideEncryption = ossv2.Ptr("KMS")
-		request.ServerSideEncryptionKeyId = ossv2.Ptr(o.encryptionKeyID)
+	o.sse.applyTo(request)
+
+	hash := crc64.New(crc64Table)
+	body = io.TeeReader(body, hash)
+
+	// Buffer up to one part to find out whether the body needs a multipart upload
+	head := &bytes.Buffer{}
+	if _, err := io.CopyN(head, body, o.uploadPartSize); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to read object %s for uploading to bucket %s", key, bucket)
 	}
 
-	_, err := o.client.PutObject(ctx, request)
+	var err error
+	var serverCRC *string
+	if int64(head.Len()) < o.uploadPartSize {
+		request.Body = bytes.NewReader(head.Bytes())
+		var result *ossv2.PutObjectResult
+		if result, err = o.client.PutObject(ctx, request); err == nil {
+			serverCRC = result.HashCRC64
+		}
+	} else {
+		uploader := ossv2.NewUploader(uploadClient(o.client), func(uo *ossv2.UploaderOptions) {
+			uo.PartSize = o.uploadPartSize
+			uo.ParallelNum = o.uploadConcurrency
+			uo.LeavePartsOnError = false
+		})
+		var result *ossv2.UploadResult
+		if result, err = uploader.UploadFrom(ctx, request, io.MultiReader(head, body)); err == nil {
+			serverCRC = result.HashCRC64
+		}
+	}
 	if err != nil {
-		if o.encryptionKeyID != "" {
+		err = o.retry.transferError(ctx, err)
+		if o.sse != nil {
 			return errors.Wrapf(err, "failed to put object %s to bucket %s with encryption", key, bucket)
 		}
 		return errors.Wrapf(err, "failed to put object %s to bucket %s", key, bucket)
 	}
+
+	// With client-side encryption OSS computes the CRC64 of the ciphertext, which
+	// the SDK already verifies for every request
+	if o.cseKeyFile == "" && o.cseKMSKeyID == "" {
+		return verifyCRC64(bucket, key, serverCRC, hash.Sum64())
+	}
 	return nil
 }
 
 // ObjectExists checks if there is an object with the given key in the object storage bucket.
+// The replica bucket is checked when the bucket is unavailable.
 func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return false, errors.Wrapf(err, "failed to update OSS client for checking object %s", key)
-	}
+	return readWithFallback(o, bucket, "check object "+key, func(store *ObjectStore, bucket string) (bool, error) {
+		return store.objectExists(bucket, key)
+	})
+}
 
-	ctx := context.Background()
+// objectExists checks if the object exists in the bucket
+func (o *ObjectStore) objectExists(bucket, key string) (bool, error) {
+	ctx, cancel := o.retry.requestContext()
+	defer cancel()
 	request := &ossv2.HeadObjectRequest{
 		Bucket: ossv2.Ptr(bucket),
 		Key:    ossv2.Ptr(key),
@@ -181,25 +514,51 @@ func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
 
 // GetObject retrieves the object with the given key from the specified
 // bucket in object storage.
+// The object is fetched in parallel byte ranges of downloadRangeSize, and a
+// range whose stream breaks is resumed from its last received byte.
+// An object in an archive storage class is restored first. Only backup contents
+// wait up to restoreTimeout for it, other reads fail until the restore completes.
+// The CRC64 of the content is checked against the one stored by OSS once the
+// last byte is read, a corrupted object fails the read with checksumMismatchError.
+// The object is read from the replica bucket when the bucket is unavailable.
 func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return nil, errors.Wrapf(err, "failed to update OSS client for getting object %s", key)
-	}
+	return readWithFallback(o, bucket, "get object "+key, func(store *ObjectStore, bucket string) (io.ReadCloser, error) {
+		return store.getObject(bucket, key)
+	})
+}
 
-	ctx := context.Background()
-	request := &ossv2.GetObjectRequest{
+// getObject reads the object from the bucket
+func (o *ObjectStore) getObject(bucket, key string) (io.ReadCloser, error) {
+	request := &ossv2.HeadObjectRequest{
 		Bucket: ossv2.Ptr(bucket),
 		Key:    ossv2.Ptr(key),
 	}
 
 	// Note: V2 SDK handles encryption automatically based on client config
 	// If encryption is needed, it should be configured at client level
-	result, err := o.client.GetObject(ctx, request)
+	headCtx, cancel := o.retry.requestContext()
+	result, err := o.client.HeadObject(headCtx, request)
+	cancel()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get object %s from bucket %s", key, bucket)
 	}
-	return result.Body, nil
+
+	if isArchived(result) {
+		if result, err = o.restoreObject(bucket, key, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.ContentLength == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	reader := newRangeReader(o.log, o.client, bucket, key, ossv2.ToString(result.ETag), result.ContentLength,
+		o.downloadRangeSize, o.downloadConcurrency, o.retry)
+	if o.cseKeyFile == "" && o.cseKMSKeyID == "" {
+		reader.expectCRC64(result.HashCRC64)
+	}
+	return reader, nil
 }
 
 // ListCommonPrefixes gets a list of all object key prefixes that start with
@@ -214,13 +573,15 @@ func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
 //
 // and the provided prefix arg is "a-prefix/", and the delimiter is "/",
 // this will return the slice {"a-prefix/foo-1/", "a-prefix/foo-2/"}.
+// The replica bucket is listed when the bucket is unavailable.
 func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return nil, errors.Wrapf(err, "failed to update OSS client for listing common prefixes")
-	}
+	return readWithFallback(o, bucket, "list prefixes under "+prefix, func(store *ObjectStore, bucket string) ([]string, error) {
+		return store.listCommonPrefixes(bucket, prefix, delimiter)
+	})
+}
 
-	ctx := context.Background()
+// listCommonPrefixes lists the common prefixes in the bucket
+func (o *ObjectStore) listCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
 	var res []string
 	continuationToken := ""
 	maxKeys := int32(50)
@@ -236,7 +597,9 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 			request.ContinuationToken = ossv2.Ptr(continuationToken)
 		}
 
+		ctx, cancel := o.retry.requestContext()
 		result, err := o.client.ListObjectsV2(ctx, request)
+		cancel()
 		if err != nil {
 			return res, errors.Wrapf(err, "failed to list objects with prefix %s in bucket %s", prefix, bucket)
 		}
@@ -261,13 +624,15 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 
 // ListObjects gets a list of all keys in the specified bucket
 // that have the given prefix.
+// The replica bucket is listed when the bucket is unavailable.
 func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return nil, errors.Wrapf(err, "failed to update OSS client for listing objects")
-	}
+	return readWithFallback(o, bucket, "list objects under "+prefix, func(store *ObjectStore, bucket string) ([]string, error) {
+		return store.listObjects(bucket, prefix)
+	})
+}
 
-	ctx := context.Background()
+// listObjects lists the objects in the bucket
+func (o *ObjectStore) listObjects(bucket, prefix string) ([]string, error) {
 	var res []string
 	continuationToken := ""
 	maxKeys := int32(50)
@@ -282,7 +647,9 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 			request.ContinuationToken = ossv2.Ptr(continuationToken)
 		}
 
+		ctx, cancel := o.retry.requestContext()
 		result, err := o.client.ListObjectsV2(ctx, request)
+		cancel()
 		if err != nil {
 			return res, errors.Wrapf(err, "failed to list objects with prefix %s in bucket %s", prefix, bucket)
 		}
@@ -307,13 +674,24 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 
 // DeleteObject removes the object with the specified key from the given
 // bucket.
+// An object still retained by the WORM policy of the bucket is left in place
+// with a warning instead of an error, so deleting a backup does not keep
+// failing until the retention period ends.
+// With a mirror bucket the object is deleted from both buckets.
 func (o *ObjectStore) DeleteObject(bucket, key string) error {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return errors.Wrapf(err, "failed to update OSS client for deleting object %s", key)
+	if err := o.deleteObject(bucket, key); err != nil {
+		return err
 	}
+	if o.mirror != nil {
+		return o.mirror.deleteObject(key)
+	}
+	return nil
+}
 
-	ctx := context.Background()
+// deleteObject deletes the object from the primary bucket
+func (o *ObjectStore) deleteObject(bucket, key string) error {
+	ctx, cancel := o.retry.requestContext()
+	defer cancel()
 	request := &ossv2.DeleteObjectRequest{
 		Bucket: ossv2.Ptr(bucket),
 		Key:    ossv2.Ptr(key),
@@ -321,19 +699,28 @@ func (o *ObjectStore) DeleteObject(bucket, key string) error {
 
 	_, err := o.client.DeleteObject(ctx, request)
 	if err != nil {
+		if isWormProtected(err) {
+			if until := o.retainedUntil(ctx, bucket, key); !until.IsZero() {
+				o.log.Warnf("object %s in bucket %s is retained until %s by the bucket WORM retention policy, not deleting it",
+					key, bucket, until.UTC().Format(time.RFC3339))
+			} else {
+				o.log.Warnf("object %s in bucket %s is retained by the bucket WORM retention policy, not deleting it", key, bucket)
+			}
+			return nil
+		}
 		return errors.Wrapf(err, "failed to delete object %s from bucket %s", key, bucket)
 	}
 	return nil
 }
 
 // CreateSignedURL creates a pre-signed URL for the given bucket and key that expires after ttl.
+// The URL points to publicEndpoint when it is configured, so that it can be used
+// outside the network of the internal endpoint.
+// With SSE-C the key headers are part of the signature, and must be sent
+// along with the URL to download the object.
 func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
-	// Update OSS client if needed (for STS token refresh)
-	if err := o.updateOssClient(); err != nil {
-		return "", errors.Wrapf(err, "failed to update OSS client for creating signed URL")
-	}
-
-	ctx := context.Background()
+	ctx, cancel := o.retry.requestContext()
+	defer cancel()
 	request := &ossv2.GetObjectRequest{
 		Bucket: ossv2.Ptr(bucket),
 		Key:    ossv2.Ptr(key),
@@ -350,19 +737,14 @@ func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (st
 // ObjectStore internal utility functions (not part of Velero plugin interface)
 // ============================================================================
 
-// newCredentialsProvider creates a credentials provider from access key, secret, and optional STS token
-func newCredentialsProvider(accessKeyID, accessKeySecret, stsToken string) credentials.CredentialsProvider {
-	if len(stsToken) == 0 {
-		return credentials.NewStaticCredentialsProvider(accessKeyID, accessKeySecret)
-	}
-	return credentials.NewStaticCredentialsProvider(accessKeyID, accessKeySecret, stsToken)
-}
-
 // buildOssConfig builds OSS client configuration with credentials, endpoint, and region
 // V2 SDK supports both Region+Endpoint or just Endpoint (like V1)
-func buildOssConfig(credProvider credentials.CredentialsProvider, endpoint, region string) (*ossv2.Config, error) {
+func buildOssConfig(credProvider credentials.CredentialsProvider, endpoint, region string, policy *retryPolicy) (*ossv2.Config, error) {
 	cfg := ossv2.LoadDefaultConfig().
-		WithCredentialsProvider(credProvider)
+		WithCredentialsProvider(credProvider).
+		WithRetryer(policy).
+		WithConnectTimeout(policy.connectTimeout).
+		WithReadWriteTimeout(policy.readWriteTimeout)
 
 	// If endpoint is specified, use it directly (like V1 behavior)
 	// Otherwise, use region to let SDK construct the endpoint
@@ -381,41 +763,69 @@ func buildOssConfig(credProvider credentials.CredentialsProvider, endpoint, regi
 	return cfg, nil
 }
 
-// getOssClient creates a new OSS client using the provided credentials
-// This function only handles OSS client initialization, credentials should be obtained separately
+// getOssClient creates a new OSS client using the cached credentials of the ObjectStore
+// The client is created once, and picks up refreshed credentials on every request
 // V2 SDK supports both Region+Endpoint or just Endpoint (like V1)
-func (o *ObjectStore) getOssClient(cred *ossCredentials) (*ossv2.Client, error) {
-	credProvider := newCredentialsProvider(cred.accessKeyID, cred.accessKeySecret, cred.stsToken)
-	cfg, err := buildOssConfig(credProvider, o.endpoint, o.region)
+func (o *ObjectStore) getOssClient() (*ossv2.Client, error) {
+	cfg, err := buildOssConfig(o.credentials, o.endpoint, o.region, o.retry)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to build OSS config")
 	}
+	o.applyBandwidthLimits(cfg)
 
 	client := ossv2.NewClient(cfg)
 	return client, nil
 }
 
-// updateOssClient updates OSS client with new STS token if RAM role is provided
-func (o *ObjectStore) updateOssClient() error {
-	if len(o.ramRole) == 0 {
-		return nil
+// applyBandwidthLimits limits the bandwidth of the client with token buckets
+// shared by all its requests, so single, multipart and ranged transfers together
+// stay within the limits however many of them run in parallel
+func (o *ObjectStore) applyBandwidthLimits(cfg *ossv2.Config) {
+	// The SDK takes the limits in KiB/s
+	if o.uploadBandwidthLimit > 0 {
+		cfg.WithUploadBandwidthlimit((o.uploadBandwidthLimit + 1023) / 1024)
 	}
+	if o.downloadBandwidthLimit > 0 {
+		cfg.WithDownloadBandwidthlimit((o.downloadBandwidthLimit + 1023) / 1024)
+	}
+}
 
-	accessKeyID, accessKeySecret, stsToken, err := getSTSAK(o.ramRole)
+// getPresignClient creates the client signing URLs for the public endpoint. Only
+// the host of the URLs differs, the signature does not depend on the endpoint.
+func (o *ObjectStore) getPresignClient() (*ossv2.Client, error) {
+	cfg, err := buildOssConfig(o.credentials, o.publicEndpoint, o.region, o.retry)
 	if err != nil {
-		return errors.Wrapf(err, "failed to get STS token for RAM role %s", o.ramRole)
+		return nil, errors.Wrapf(err, "failed to build OSS config for %s", publicEndpointConfigKey)
 	}
-	cred := &ossCredentials{
-		accessKeyID:     accessKeyID,
-		accessKeySecret: accessKeySecret,
-		stsToken:        stsToken,
+	if isCNameEndpoint(o.publicEndpoint) {
+		cfg = cfg.WithUseCName(true)
 	}
-	client, err := o.getOssClient(cred)
+	return ossv2.NewClient(cfg), nil
+}
+
+// wrapOssClient wraps the raw OSS client, adding an encryption client when
+// client-side encryption is configured. The master cipher shares the credentials
+// of the client, so a KMS key is used with fresh STS tokens.
+func (o *ObjectStore) wrapOssClient(client *ossv2.Client) (*ossClientWrapper, error) {
+	var presigner *ossv2.Client
+	if o.publicEndpoint != "" {
+		var err error
+		if presigner, err = o.getPresignClient(); err != nil {
+			return nil, err
+		}
+	}
+
+	masterCipher, err := getMasterCipher(o.cseKeyFile, o.cseKMSKeyID, o.region, o.credentials)
 	if err != nil {
-		return errors.Wrapf(err, "failed to update OSS client")
+		return nil, errors.Wrapf(err, "failed to set up client-side encryption")
+	}
+	if masterCipher == nil {
+		return &ossClientWrapper{client: client, headers: o.sse.headers(), presigner: presigner}, nil
 	}
 
-	o.rawClient = client
-	o.client = &ossClientWrapper{client: o.rawClient}
-	return nil
+	encryption, err := ossv2.NewEncryptionClient(client, masterCipher)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create OSS encryption client")
+	}
+	return &ossClientWrapper{client: client, encryption: encryption, presigner: presigner}, nil
 }
@@ -14,15 +14,26 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // mockOSSClient is a mock implementation of ossClientInterface for testing
@@ -78,6 +89,102 @@ func (m *mockOSSClient) Presign(ctx context.Context, request any, optFns ...func
 	return args.Get(0).(*ossv2.PresignResult), args.Error(1)
 }
 
+func (m *mockOSSClient) RestoreObject(ctx context.Context, request *ossv2.RestoreObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.RestoreObjectResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.RestoreObjectResult), args.Error(1)
+}
+
+func (m *mockOSSClient) GetBucketLocation(ctx context.Context, request *ossv2.GetBucketLocationRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketLocationResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.GetBucketLocationResult), args.Error(1)
+}
+
+func (m *mockOSSClient) GetBucketInfo(ctx context.Context, request *ossv2.GetBucketInfoRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketInfoResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.GetBucketInfoResult), args.Error(1)
+}
+
+func (m *mockOSSClient) GetBucketWorm(ctx context.Context, request *ossv2.GetBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetBucketWormResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.GetBucketWormResult), args.Error(1)
+}
+
+func (m *mockOSSClient) InitiateBucketWorm(ctx context.Context, request *ossv2.InitiateBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateBucketWormResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.InitiateBucketWormResult), args.Error(1)
+}
+
+func (m *mockOSSClient) CompleteBucketWorm(ctx context.Context, request *ossv2.CompleteBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteBucketWormResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.CompleteBucketWormResult), args.Error(1)
+}
+
+func (m *mockOSSClient) ExtendBucketWorm(ctx context.Context, request *ossv2.ExtendBucketWormRequest, optFns ...func(*ossv2.Options)) (*ossv2.ExtendBucketWormResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.ExtendBucketWormResult), args.Error(1)
+}
+
+func (m *mockOSSClient) InitiateMultipartUpload(ctx context.Context, request *ossv2.InitiateMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.InitiateMultipartUploadResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.InitiateMultipartUploadResult), args.Error(1)
+}
+
+func (m *mockOSSClient) UploadPart(ctx context.Context, request *ossv2.UploadPartRequest, optFns ...func(*ossv2.Options)) (*ossv2.UploadPartResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.UploadPartResult), args.Error(1)
+}
+
+func (m *mockOSSClient) CompleteMultipartUpload(ctx context.Context, request *ossv2.CompleteMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.CompleteMultipartUploadResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.CompleteMultipartUploadResult), args.Error(1)
+}
+
+func (m *mockOSSClient) AbortMultipartUpload(ctx context.Context, request *ossv2.AbortMultipartUploadRequest, optFns ...func(*ossv2.Options)) (*ossv2.AbortMultipartUploadResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.AbortMultipartUploadResult), args.Error(1)
+}
+
+func (m *mockOSSClient) ListParts(ctx context.Context, request *ossv2.ListPartsRequest, optFns ...func(*ossv2.Options)) (*ossv2.ListPartsResult, error) {
+	args := m.Called(ctx, request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ossv2.ListPartsResult), args.Error(1)
+}
+
 func TestNewCredentialsProvider(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -104,7 +211,11 @@ func TestNewCredentialsProvider(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			provider := newCredentialsProvider(tc.accessKeyID, tc.accessKeySecret, tc.stsToken)
+			provider := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{
+				accessKeyID:     tc.accessKeyID,
+				accessKeySecret: tc.accessKeySecret,
+				stsToken:        tc.stsToken,
+			}, nil)
 			assert.NotNil(t, provider)
 
 			// Verify provider can get credentials
@@ -122,9 +233,109 @@ func TestNewCredentialsProvider(t *testing.T) {
 	}
 }
 
+func TestInit_PerLocationCredentialsFiles(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "env-ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "env-sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+
+	dir := t.TempDir()
+	writeCredentialsFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	primaryFile := writeCredentialsFile("primary", "ALIBABA_CLOUD_ACCESS_KEY_ID=primary-ak\nALIBABA_CLOUD_ACCESS_KEY_SECRET=primary-sk\n")
+	vaultFile := writeCredentialsFile("vault", "ALIBABA_CLOUD_ACCESS_KEY_ID=vault-ak\nALIBABA_CLOUD_ACCESS_KEY_SECRET=vault-sk\n")
+
+	newStore := func(config map[string]string) *ObjectStore {
+		config[regionConfigKey] = "cn-hangzhou"
+		config[notOnECSConfigKey] = "true"
+		o := newObjectStore(newTestLogger())
+		require.NoError(t, o.Init(config))
+		return o
+	}
+	primary := newStore(map[string]string{credFileConfigKey: primaryFile})
+	vault := newStore(map[string]string{credFileConfigKey: vaultFile})
+	fromEnv := newStore(map[string]string{})
+
+	for _, tc := range []struct {
+		store       *ObjectStore
+		accessKeyID string
+	}{
+		{store: primary, accessKeyID: "primary-ak"},
+		{store: vault, accessKeyID: "vault-ak"},
+		{store: fromEnv, accessKeyID: "env-ak"},
+	} {
+		cred, err := tc.store.credentials.GetCredentials(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, tc.accessKeyID, cred.AccessKeyID)
+	}
+
+	// Reading the files leaves the process environment untouched
+	assert.Equal(t, "env-ak", os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID"))
+	assert.Equal(t, "env-sk", os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET"))
+}
+
+func TestInit_OssRegion(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+	t.Setenv("VELERO_FOR_ACK", "")
+
+	tests := []struct {
+		name             string
+		config           map[string]string
+		expectedRegion   string
+		expectedEndpoint string
+	}{
+		{
+			name:             "bucket in a DR region",
+			config:           map[string]string{regionConfigKey: "cn-beijing", ossRegionConfigKey: "cn-shanghai"},
+			expectedRegion:   "cn-shanghai",
+			expectedEndpoint: "https://oss-cn-shanghai.aliyuncs.com",
+		},
+		{
+			name:             "bucket in the ECS region",
+			config:           map[string]string{ecsRegionConfigKey: "cn-beijing", ossRegionConfigKey: "cn-beijing"},
+			expectedRegion:   "cn-beijing",
+			expectedEndpoint: "https://oss-cn-beijing-internal.aliyuncs.com",
+		},
+		{
+			name: "explicit endpoint wins",
+			config: map[string]string{
+				ossRegionConfigKey: "cn-shanghai",
+				endpointConfigKey:  "https://oss-custom.example.com",
+			},
+			expectedRegion:   "cn-shanghai",
+			expectedEndpoint: "https://oss-custom.example.com",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// The plugin runs on ECS, with credentials from the environment
+			tc.config[notOnECSConfigKey] = "false"
+			if tc.config[ecsRegionConfigKey] == "" && tc.config[regionConfigKey] == "" {
+				tc.config[ecsRegionConfigKey] = "cn-beijing"
+			}
+			o := newObjectStore(newTestLogger())
+			require.NoError(t, o.Init(tc.config))
+			assert.Equal(t, tc.expectedRegion, o.region)
+			assert.Equal(t, tc.expectedEndpoint, o.endpoint)
+		})
+	}
+}
+
 func TestBuildOssConfig(t *testing.T) {
 	// Create a test credentials provider
 	credProvider := credentials.NewStaticCredentialsProvider("test-ak", "test-sk")
+	policy, err := getRetryPolicy(map[string]string{
+		connectTimeoutConfigKey:   "3s",
+		readWriteTimeoutConfigKey: "1m",
+	})
+	require.NoError(t, err)
 
 	tests := []struct {
 		name          string
@@ -139,6 +350,9 @@ func TestBuildOssConfig(t *testing.T) {
 			region:   "cn-hangzhou",
 			validate: func(t *testing.T, cfg *ossv2.Config) {
 				assert.NotNil(t, cfg)
+				assert.Same(t, policy, cfg.Retryer)
+				assert.Equal(t, 3*time.Second, *cfg.ConnectTimeout)
+				assert.Equal(t, time.Minute, *cfg.ReadWriteTimeout)
 			},
 		},
 		{
@@ -167,7 +381,7 @@ func TestBuildOssConfig(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			cfg, err := buildOssConfig(credProvider, tc.endpoint, tc.region)
+			cfg, err := buildOssConfig(credProvider, tc.endpoint, tc.region, policy)
 
 			if tc.expectedError != "" {
 				assert.Error(t, err)
@@ -185,6 +399,102 @@ func TestBuildOssConfig(t *testing.T) {
 	}
 }
 
+func TestApplyBandwidthLimits(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]string
+		expectedUpload   *int64
+		expectedDownload *int64
+		expectedError    string
+	}{
+		{
+			name:   "no limits by default",
+			config: map[string]string{},
+		},
+		{
+			name: "limits are converted to KiB per second",
+			config: map[string]string{
+				uploadBandwidthLimitConfigKey:   "50Mi",
+				downloadBandwidthLimitConfigKey: "1500",
+			},
+			expectedUpload:   ossv2.Ptr(int64(50 * 1024)),
+			expectedDownload: ossv2.Ptr(int64(2)),
+		},
+		{
+			name:          "invalid limit",
+			config:        map[string]string{uploadBandwidthLimitConfigKey: "-1Mi"},
+			expectedError: "must be a positive size",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &ObjectStore{}
+			var err error
+			o.uploadBandwidthLimit, err = getConfigSize(tc.config, uploadBandwidthLimitConfigKey, 0)
+			if err == nil {
+				o.downloadBandwidthLimit, err = getConfigSize(tc.config, downloadBandwidthLimitConfigKey, 0)
+			}
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			cfg := ossv2.NewConfig()
+			o.applyBandwidthLimits(cfg)
+			assert.Equal(t, tc.expectedUpload, cfg.UploadBandwidthlimit)
+			assert.Equal(t, tc.expectedDownload, cfg.DownloadBandwidthlimit)
+		})
+	}
+}
+
+func TestCreateSignedURL(t *testing.T) {
+	tests := []struct {
+		name           string
+		publicEndpoint string
+		expectedPrefix string
+	}{
+		{
+			name:           "signed against the data endpoint",
+			expectedPrefix: "https://bucket.oss-cn-hangzhou-internal.aliyuncs.com/backups/b1.tar.gz?",
+		},
+		{
+			name:           "signed against the public endpoint",
+			publicEndpoint: "https://oss-cn-hangzhou.aliyuncs.com",
+			expectedPrefix: "https://bucket.oss-cn-hangzhou.aliyuncs.com/backups/b1.tar.gz?",
+		},
+		{
+			name:           "signed against a custom domain",
+			publicEndpoint: "https://backups.example.com",
+			expectedPrefix: "https://backups.example.com/backups/b1.tar.gz?",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := getRetryPolicy(map[string]string{})
+			require.NoError(t, err)
+			o := &ObjectStore{
+				log:            newTestLogger(),
+				credentials:    newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil),
+				endpoint:       "https://oss-cn-hangzhou-internal.aliyuncs.com",
+				region:         "cn-hangzhou",
+				publicEndpoint: tc.publicEndpoint,
+				retry:          policy,
+			}
+			rawClient, err := o.getOssClient()
+			require.NoError(t, err)
+			o.client, err = o.wrapOssClient(rawClient)
+			require.NoError(t, err)
+
+			url, err := o.CreateSignedURL("bucket", "backups/b1.tar.gz", time.Minute)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(url, tc.expectedPrefix), url)
+		})
+	}
+}
+
 func TestObjectExists(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -238,3 +548,205 @@ func TestObjectExists(t *testing.T) {
 		})
 	}
 }
+
+func TestPutObject(t *testing.T) {
+	partSize := ossv2.MinPartSize
+
+	tests := []struct {
+		name          string
+		bodySize      int64
+		sse           *serverSideEncryption
+		setupMock     func(client *mockOSSClient)
+		expectedError string
+	}{
+		{
+			name:     "small body uses single PutObject with KMS encryption",
+			bodySize: partSize - 1,
+			sse:      &serverSideEncryption{algorithm: "KMS", keyID: "kms-key"},
+			setupMock: func(client *mockOSSClient) {
+				client.On("PutObject", mock.Anything, mock.MatchedBy(func(req *ossv2.PutObjectRequest) bool {
+					return ossv2.ToString(req.ServerSideEncryption) == "KMS" &&
+						ossv2.ToString(req.ServerSideEncryptionKeyId) == "kms-key"
+				})).Return(&ossv2.PutObjectResult{}, nil)
+			},
+		},
+		{
+			name:     "large body uses multipart upload with KMS encryption",
+			bodySize: partSize*2 + 1,
+			sse:      &serverSideEncryption{algorithm: "KMS", keyID: "kms-key"},
+			setupMock: func(client *mockOSSClient) {
+				client.On("InitiateMultipartUpload", mock.Anything, mock.MatchedBy(func(req *ossv2.InitiateMultipartUploadRequest) bool {
+					return ossv2.ToString(req.ServerSideEncryption) == "KMS" &&
+						ossv2.ToString(req.ServerSideEncryptionKeyId) == "kms-key"
+				})).Return(&ossv2.InitiateMultipartUploadResult{UploadId: ossv2.Ptr("upload-id")}, nil)
+				client.On("UploadPart", mock.Anything, mock.Anything).Return(&ossv2.UploadPartResult{ETag: ossv2.Ptr("etag")}, nil).Times(3)
+				client.On("CompleteMultipartUpload", mock.Anything, mock.MatchedBy(func(req *ossv2.CompleteMultipartUploadRequest) bool {
+					return ossv2.ToString(req.UploadId) == "upload-id" && len(req.CompleteMultipartUpload.Parts) == 3
+				})).Return(&ossv2.CompleteMultipartUploadResult{}, nil)
+			},
+		},
+		{
+			name:     "failed part aborts the multipart upload",
+			bodySize: partSize * 2,
+			setupMock: func(client *mockOSSClient) {
+				client.On("InitiateMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.InitiateMultipartUploadResult{UploadId: ossv2.Ptr("upload-id")}, nil)
+				client.On("UploadPart", mock.Anything, mock.Anything).Return(nil, errors.New("connection reset"))
+				client.On("AbortMultipartUpload", mock.Anything, mock.MatchedBy(func(req *ossv2.AbortMultipartUploadRequest) bool {
+					return ossv2.ToString(req.UploadId) == "upload-id"
+				})).Return(&ossv2.AbortMultipartUploadResult{}, nil)
+			},
+			expectedError: "connection reset",
+		},
+		{
+			name:     "single PutObject checksum is verified",
+			bodySize: partSize - 1,
+			setupMock: func(client *mockOSSClient) {
+				client.On("PutObject", mock.Anything, mock.Anything).Return(&ossv2.PutObjectResult{
+					HashCRC64: ossv2.Ptr(zeroCRC64(partSize - 1)),
+				}, nil)
+			},
+		},
+		{
+			name:     "multipart upload checksum is verified",
+			bodySize: partSize*2 + 1,
+			setupMock: func(client *mockOSSClient) {
+				client.On("InitiateMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.InitiateMultipartUploadResult{UploadId: ossv2.Ptr("upload-id")}, nil)
+				client.On("UploadPart", mock.Anything, mock.Anything).Return(&ossv2.UploadPartResult{ETag: ossv2.Ptr("etag")}, nil).Times(3)
+				client.On("CompleteMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.CompleteMultipartUploadResult{
+					HashCRC64: ossv2.Ptr(zeroCRC64(partSize*2 + 1)),
+				}, nil)
+			},
+		},
+		{
+			name:     "corrupted upload is reported",
+			bodySize: partSize*2 + 1,
+			setupMock: func(client *mockOSSClient) {
+				client.On("InitiateMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.InitiateMultipartUploadResult{UploadId: ossv2.Ptr("upload-id")}, nil)
+				client.On("UploadPart", mock.Anything, mock.Anything).Return(&ossv2.UploadPartResult{ETag: ossv2.Ptr("etag")}, nil).Times(3)
+				client.On("CompleteMultipartUpload", mock.Anything, mock.Anything).Return(&ossv2.CompleteMultipartUploadResult{
+					HashCRC64: ossv2.Ptr(zeroCRC64(partSize * 2)),
+				}, nil)
+			},
+			expectedError: "object key in bucket bucket is corrupted",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := new(mockOSSClient)
+			defer client.AssertExpectations(t)
+			tc.setupMock(client)
+
+			o := &ObjectStore{
+				client:            client,
+				sse:               tc.sse,
+				uploadPartSize:    partSize,
+				uploadConcurrency: 2,
+			}
+
+			err := o.PutObject("bucket", "key", io.LimitReader(zeroReader{}, tc.bodySize))
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPutObject_TransferTimeout(t *testing.T) {
+	client := new(mockOSSClient)
+	defer client.AssertExpectations(t)
+
+	// The upload stalls until its deadline
+	client.On("PutObject", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil, context.DeadlineExceeded)
+
+	o := &ObjectStore{
+		client:         client,
+		uploadPartSize: ossv2.MinPartSize,
+		retry:          &retryPolicy{transferTimeout: 10 * time.Millisecond},
+	}
+
+	err := o.PutObject("bucket", "key", bytes.NewReader([]byte("data")))
+	assert.ErrorContains(t, err, "failed to put object key to bucket bucket: timed out after 10ms, increase transferTimeout if needed")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// zeroCRC64 returns the x-oss-hash-crc64ecma value of size zero bytes
+func zeroCRC64(size int64) string {
+	return strconv.FormatUint(crc64.Checksum(make([]byte, size), crc64Table), 10)
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestObjectStore_ConcurrentPutAndGet(t *testing.T) {
+	server := newFakeOSSServer(t)
+
+	// The credentials are within the refresh window, so they are refreshed in the
+	// background while the requests are signed
+	var fetches atomic.Int32
+	credentials := newCachedCredentialsProvider(newTestLogger(),
+		&ossCredentials{accessKeyID: "ak", accessKeySecret: "sk", stsToken: "token-0", expiration: time.Now().Add(2 * time.Minute)},
+		func(ctx context.Context) (*ossCredentials, error) {
+			n := fetches.Add(1)
+			return &ossCredentials{
+				accessKeyID:     "ak",
+				accessKeySecret: "sk",
+				stsToken:        fmt.Sprintf("token-%d", n),
+				expiration:      time.Now().Add(2 * time.Minute),
+			}, nil
+		})
+	policy, err := getRetryPolicy(map[string]string{})
+	require.NoError(t, err)
+
+	o := &ObjectStore{
+		log:                 newTestLogger(),
+		credentials:         credentials,
+		endpoint:            server.URL,
+		region:              "cn-hangzhou",
+		uploadPartSize:      ossv2.MinPartSize,
+		uploadConcurrency:   2,
+		downloadRangeSize:   4 * 1024,
+		downloadConcurrency: 4,
+		retry:               policy,
+	}
+	cfg, err := buildOssConfig(credentials, server.URL, o.region, policy)
+	require.NoError(t, err)
+	o.client, err = o.wrapOssClient(ossv2.NewClient(cfg.WithUsePathStyle(true)))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("backups/backup-%d/velero-backup.json", i)
+			for round := range 3 {
+				// Every other object is uploaded in parts
+				data := newTestObject(int(ossv2.MinPartSize)*(i%2*2) + 64*1024 + i + round)
+				if !assert.NoError(t, o.PutObject("bucket", key, bytes.NewReader(data))) {
+					return
+				}
+				body, err := o.GetObject("bucket", key)
+				if !assert.NoError(t, err) {
+					return
+				}
+				read, err := io.ReadAll(body)
+				body.Close()
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(data, read), "object %s is read back as written", key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool { return fetches.Load() > 0 }, time.Second, time.Millisecond)
+}
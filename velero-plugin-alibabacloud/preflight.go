@@ -0,0 +1,153 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	alicloudErr "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+)
+
+// preflightKey is the name of the probe object written by the preflight check
+// under the prefix of the location
+const preflightKey = ".velero-plugin-preflight"
+
+// preflightContent is the content of the probe object written by the preflight check
+var preflightContent = []byte("velero-plugin-alibabacloud preflight check\n")
+
+// preflightPassed holds the locations whose preflight check passed. Velero
+// calls Init every time it validates a location, and the check is only run
+// again once the plugin restarts.
+var preflightPassed sync.Map
+
+// preflight checks that the bucket exists, and that an object can be written,
+// read and deleted under prefix with the credentials and encryption settings of
+// the location. A misconfiguration then fails Init, instead of the first backup.
+// With worm the probe object could not be deleted during the retention period,
+// so only the bucket is checked.
+func (o *ObjectStore) preflight(bucket, prefix string, worm bool) error {
+	location := o.endpoint + "/" + bucket + "/" + prefix
+	if _, ok := preflightPassed.Load(location); ok {
+		return nil
+	}
+
+	ctx, cancel := o.retry.requestContext()
+	_, err := o.client.GetBucketInfo(ctx, &ossv2.GetBucketInfoRequest{Bucket: ossv2.Ptr(bucket)})
+	cancel()
+	if err != nil {
+		// Backups do not need oss:GetBucketInfo, so the object checks are still run
+		if getServiceErrorCode(err) == "AccessDenied" {
+			o.log.Warnf("preflight check could not get the info of bucket %s, grant oss:GetBucketInfo on acs:oss:*:*:%s to check it: %v",
+				bucket, bucket, err)
+		} else {
+			return o.preflightError(err, bucket, "get the info of bucket "+bucket, "oss:GetBucketInfo", bucket)
+		}
+	}
+
+	if worm {
+		o.log.Infof("preflight check of bucket %s passed, objects are not checked as they cannot be deleted with WORM retention", bucket)
+		preflightPassed.Store(location, true)
+		return nil
+	}
+
+	key := path.Join(prefix, preflightKey)
+	resource := bucket + "/" + path.Join(prefix, "*")
+
+	if err := o.PutObject(bucket, key, bytes.NewReader(preflightContent)); err != nil {
+		return o.preflightError(err, bucket, "write object "+key, "oss:PutObject", resource)
+	}
+
+	body, err := o.GetObject(bucket, key)
+	if err == nil {
+		var content []byte
+		content, err = io.ReadAll(body)
+		body.Close()
+		if err == nil && !bytes.Equal(content, preflightContent) {
+			err = errors.New("content differs from the written content")
+		}
+	}
+	if err != nil {
+		return o.preflightError(err, bucket, "read object "+key, "oss:GetObject", resource)
+	}
+
+	if err := o.DeleteObject(bucket, key); err != nil {
+		return o.preflightError(err, bucket, "delete object "+key, "oss:DeleteObject", resource)
+	}
+
+	o.log.Infof("preflight check of bucket %s passed", bucket)
+	preflightPassed.Store(location, true)
+	return nil
+}
+
+// preflightError returns the error of a failed preflight step, with the
+// remediation of the usual causes
+func (o *ObjectStore) preflightError(err error, bucket, step, action, resource string) error {
+	var remediation string
+	switch code := getServiceErrorCode(err); {
+	case code == "NoSuchBucket":
+		remediation = fmt.Sprintf("bucket %s does not exist in region %s, check the bucket name and region", bucket, o.region)
+	case code == "InvalidAccessKeyId" || code == "SignatureDoesNotMatch" || code == "SecurityTokenExpired":
+		remediation = "the credentials are invalid, check the AccessKey pair or the RAM role of the location"
+	case isKMSError(err):
+		remediation = fmt.Sprintf("grant kms:GenerateDataKey and kms:Decrypt on %s to the RAM identity of the plugin", o.kmsKeyDescription())
+	case code == "AccessDenied":
+		remediation = fmt.Sprintf("grant %s on acs:oss:*:*:%s to the RAM identity of the plugin", action, resource)
+	}
+
+	if remediation == "" {
+		return errors.Wrapf(err, "preflight check of bucket %s failed: cannot %s", bucket, step)
+	}
+	return errors.Wrapf(err, "preflight check of bucket %s failed: cannot %s: %s", bucket, step, remediation)
+}
+
+// kmsKeyDescription describes the KMS key used to encrypt objects
+func (o *ObjectStore) kmsKeyDescription() string {
+	switch {
+	case o.cseKMSKeyID != "":
+		return "KMS key " + o.cseKMSKeyID
+	case o.sse != nil && o.sse.keyID != "":
+		return "KMS key " + o.sse.keyID
+	default:
+		return "the OSS default KMS key"
+	}
+}
+
+// getServiceErrorCode returns the error code of an OSS service error, or an
+// empty string for other errors
+func getServiceErrorCode(err error) string {
+	var serviceErr *ossv2.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Code
+	}
+	return ""
+}
+
+// isKMSError returns whether err was caused by KMS, either when OSS encrypts or
+// decrypts an object with SSE-KMS or when the plugin calls KMS for client-side
+// encryption
+func isKMSError(err error) bool {
+	var serviceErr *ossv2.ServiceError
+	if errors.As(err, &serviceErr) {
+		return strings.Contains(strings.ToLower(serviceErr.Code+" "+serviceErr.Message), "kms")
+	}
+	var kmsErr *alicloudErr.ServerError
+	return errors.As(err, &kmsErr)
+}
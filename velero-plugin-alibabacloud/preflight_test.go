@@ -0,0 +1,155 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"hash/crc64"
+	"strconv"
+	"testing"
+
+	alicloudErr "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPreflight(t *testing.T) {
+	accessDenied := &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied", Message: "You have no right to access this object because of bucket acl."}
+
+	tests := []struct {
+		name          string
+		infoErr       error
+		putErr        error
+		getErr        error
+		content       []byte
+		deleteErr     error
+		cseKMSKeyID   string
+		worm          bool
+		expectedError string
+	}{
+		{
+			name:    "all checks pass",
+			content: preflightContent,
+		},
+		{
+			name: "objects are not written with WORM retention",
+			worm: true,
+		},
+		{
+			name:    "bucket info cannot be read",
+			infoErr: accessDenied,
+			content: preflightContent,
+		},
+		{
+			name:          "bucket does not exist",
+			infoErr:       &ossv2.ServiceError{StatusCode: 404, Code: "NoSuchBucket", Message: "The specified bucket does not exist."},
+			expectedError: "bucket velero-backups does not exist in region cn-hangzhou",
+		},
+		{
+			name:          "invalid credentials",
+			infoErr:       &ossv2.ServiceError{StatusCode: 403, Code: "InvalidAccessKeyId", Message: "The OSS Access Key Id you provided does not exist in our records."},
+			expectedError: "the credentials are invalid",
+		},
+		{
+			name:          "object cannot be written",
+			putErr:        accessDenied,
+			expectedError: "grant oss:PutObject on acs:oss:*:*:velero-backups/backups/* to the RAM identity of the plugin",
+		},
+		{
+			name:          "object cannot be read",
+			content:       preflightContent,
+			getErr:        accessDenied,
+			expectedError: "grant oss:GetObject on acs:oss:*:*:velero-backups/backups/*",
+		},
+		{
+			name:          "object content differs",
+			content:       []byte("velero-plugin-alibabacloud preflight check?"),
+			expectedError: "cannot read object backups/.velero-plugin-preflight",
+		},
+		{
+			name:          "object cannot be deleted",
+			content:       preflightContent,
+			deleteErr:     accessDenied,
+			expectedError: "grant oss:DeleteObject on acs:oss:*:*:velero-backups/backups/*",
+		},
+		{
+			name:          "server-side encryption key cannot be used",
+			putErr:        &ossv2.ServiceError{StatusCode: 403, Code: "KmsServiceNotEnabled", Message: "The KMS service is not enabled for this user."},
+			expectedError: "grant kms:GenerateDataKey and kms:Decrypt on the OSS default KMS key",
+		},
+		{
+			name:          "client-side encryption key cannot be used",
+			putErr:        errors.Wrap(alicloudErr.NewServerError(403, `{"Code":"Forbidden.KeyNotFound","Message":"The specified Key is not found."}`, ""), "failed to encrypt data key with KMS key key-id"),
+			cseKMSKeyID:   "key-id",
+			expectedError: "grant kms:GenerateDataKey and kms:Decrypt on KMS key key-id",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: tc.content, getErr: tc.getErr}
+			client.On("GetBucketInfo", mock.Anything, mock.MatchedBy(func(req *ossv2.GetBucketInfoRequest) bool {
+				return ossv2.ToString(req.Bucket) == "velero-backups"
+			})).Return(&ossv2.GetBucketInfoResult{}, tc.infoErr)
+			client.On("PutObject", mock.Anything, mock.MatchedBy(func(req *ossv2.PutObjectRequest) bool {
+				return ossv2.ToString(req.Key) == "backups/.velero-plugin-preflight"
+			})).Return(&ossv2.PutObjectResult{
+				HashCRC64: ossv2.Ptr(strconv.FormatUint(crc64.Checksum(preflightContent, crc64Table), 10)),
+			}, tc.putErr)
+			client.On("HeadObject", mock.Anything, mock.Anything).Return(&ossv2.HeadObjectResult{
+				ContentLength: int64(len(tc.content)),
+				ETag:          ossv2.Ptr("etag"),
+			}, nil)
+			client.On("DeleteObject", mock.Anything, mock.Anything).Return(&ossv2.DeleteObjectResult{}, tc.deleteErr)
+
+			o := &ObjectStore{
+				log:                 newTestLogger(),
+				client:              client,
+				region:              "cn-hangzhou",
+				uploadPartSize:      ossv2.MinPartSize,
+				uploadConcurrency:   1,
+				downloadRangeSize:   defaultDownloadRangeSize,
+				downloadConcurrency: 1,
+				cseKMSKeyID:         tc.cseKMSKeyID,
+			}
+
+			preflightPassed.Clear()
+			err := o.preflight("velero-backups", "backups", tc.worm)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, "preflight check of bucket velero-backups failed")
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.worm {
+				client.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything)
+				return
+			}
+			client.AssertCalled(t, "DeleteObject", mock.Anything, mock.Anything)
+
+			// The check is not repeated when Velero validates the location again
+			assert.NoError(t, o.preflight("velero-backups", "backups", tc.worm))
+			client.AssertNumberOfCalls(t, "PutObject", 1)
+		})
+	}
+}
+
+func TestIsKMSError(t *testing.T) {
+	assert.True(t, isKMSError(&ossv2.ServiceError{Code: "KmsServiceNotEnabled"}))
+	assert.True(t, isKMSError(&ossv2.ServiceError{Code: "AccessDenied", Message: "The specified KMS key is not authorized."}))
+	assert.True(t, isKMSError(errors.Wrap(alicloudErr.NewServerError(404, `{"Code":"Forbidden.KeyNotFound"}`, ""), "failed to decrypt data key with KMS")))
+	assert.False(t, isKMSError(errors.Wrap(&ossv2.ServiceError{Code: "AccessDenied"}, "failed to put object kms/backup to bucket velero-backups")))
+	assert.False(t, isKMSError(errors.New("connection refused")))
+}
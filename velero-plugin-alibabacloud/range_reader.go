@@ -0,0 +1,227 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultDownloadRangeSize is the size of each byte range fetched by GetObject
+	defaultDownloadRangeSize = 16 * 1024 * 1024
+
+	// maxRangeRetries is how many times a broken range is resumed before giving up
+	maxRangeRetries = 3
+)
+
+// rangeResult is the outcome of fetching a single byte range
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// rangeReader streams an OSS object to the caller while fetching it in byte
+// ranges. Up to concurrency ranges are fetched ahead of the reader in parallel,
+// and a range whose stream breaks is resumed from the last byte received.
+// Ranges are requested with If-Match on the object ETag, so a concurrent
+// overwrite fails the read instead of mixing two versions of the object.
+// When the CRC64 of the object is known it is checked once the last byte is read.
+type rangeReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    logrus.FieldLogger
+	client ossClientInterface
+	retry  *retryPolicy // Transfer timeout of the read
+
+	bucket    string
+	key       string
+	etag      string
+	size      int64
+	rangeSize int64
+
+	// pending delivers the result of each range, in object order
+	pending chan chan rangeResult
+
+	current []byte
+	err     error
+
+	hash        hash.Hash64 // CRC64 of the bytes handed to the reader so far
+	expectedCRC *string     // CRC64 stored by OSS, nil if not verified
+}
+
+// newRangeReader starts fetching the object and returns a reader over its
+// content, which has to be read within the transfer timeout of policy
+func newRangeReader(log logrus.FieldLogger, client ossClientInterface, bucket, key, etag string, size, rangeSize int64, concurrency int, policy *retryPolicy) *rangeReader {
+	ctx, cancel := policy.transferContext()
+	r := &rangeReader{
+		ctx:       ctx,
+		cancel:    cancel,
+		log:       log,
+		client:    client,
+		retry:     policy,
+		bucket:    bucket,
+		key:       key,
+		etag:      etag,
+		size:      size,
+		rangeSize: rangeSize,
+		pending:   make(chan chan rangeResult, concurrency),
+		hash:      crc64.New(crc64Table),
+	}
+
+	go r.dispatch()
+	return r
+}
+
+// expectCRC64 makes the reader check the content against the CRC64 stored by OSS
+func (r *rangeReader) expectCRC64(crc *string) {
+	r.expectedCRC = crc
+}
+
+// dispatch starts a fetch for every range of the object. The capacity of
+// pending bounds the number of ranges fetched ahead of the reader.
+func (r *rangeReader) dispatch() {
+	defer close(r.pending)
+
+	for start := int64(0); start < r.size; start += r.rangeSize {
+		end := min(start+r.rangeSize, r.size)
+		result := make(chan rangeResult, 1)
+
+		select {
+		case r.pending <- result:
+		case <-r.ctx.Done():
+			return
+		}
+
+		go func(start, end int64) {
+			data, err := r.fetchRange(start, end)
+			result <- rangeResult{data: data, err: err}
+		}(start, end)
+	}
+}
+
+// fetchRange downloads the bytes in [start, end), resuming from the last
+// received byte when the connection breaks.
+func (r *rangeReader) fetchRange(start, end int64) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, end-start))
+
+	for attempt := 0; ; attempt++ {
+		offset := start + int64(buf.Len())
+		err := r.readRange(offset, end, buf)
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+
+		if r.ctx.Err() != nil {
+			return nil, r.contextError()
+		}
+		if attempt >= maxRangeRetries || !isRetryableReadError(err) {
+			return nil, errors.Wrapf(err, "failed to read bytes %d-%d of object %s", offset, end-1, r.key)
+		}
+
+		r.log.Warnf("reading bytes %d-%d of object %s in bucket %s failed, resuming from byte %d (attempt %d/%d): %v",
+			start, end-1, r.key, r.bucket, start+int64(buf.Len()), attempt+1, maxRangeRetries, err)
+	}
+}
+
+// readRange copies the bytes in [offset, end) of the object into buf
+func (r *rangeReader) readRange(offset, end int64, buf *bytes.Buffer) error {
+	request := &ossv2.GetObjectRequest{
+		Bucket:        ossv2.Ptr(r.bucket),
+		Key:           ossv2.Ptr(r.key),
+		Range:         ossv2.Ptr(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		RangeBehavior: ossv2.Ptr("standard"),
+	}
+	if r.etag != "" {
+		request.IfMatch = ossv2.Ptr(r.etag)
+	}
+
+	result, err := r.client.GetObject(r.ctx, request)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	n, err := io.Copy(buf, result.Body)
+	if err != nil {
+		return err
+	}
+	if n != end-offset {
+		return errors.Errorf("expected %d bytes, got %d", end-offset, n)
+	}
+	return nil
+}
+
+// Read reads the next bytes of the object in order
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		result, ok := <-r.pending
+		if !ok {
+			if r.ctx.Err() != nil {
+				r.err = r.contextError()
+			} else if err := verifyCRC64(r.bucket, r.key, r.expectedCRC, r.hash.Sum64()); err != nil {
+				r.err = err
+			} else {
+				r.err = io.EOF
+			}
+			continue
+		}
+
+		res := <-result
+		r.current, r.err = res.data, res.err
+		r.hash.Write(res.data)
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// contextError returns why the reader was stopped, either by Close or by the
+// transfer timeout
+func (r *rangeReader) contextError() error {
+	err := r.ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.Wrapf(r.retry.transferError(r.ctx, err), "failed to read object %s in bucket %s", r.key, r.bucket)
+	}
+	return err
+}
+
+// Close stops all outstanding range fetches
+func (r *rangeReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// isRetryableReadError reports whether a failed range read may succeed when
+// retried. Client errors returned by OSS, such as a failed If-Match, are final.
+func isRetryableReadError(err error) bool {
+	var serviceErr *ossv2.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode >= 500
+	}
+	return true
+}
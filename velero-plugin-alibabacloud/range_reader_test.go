@@ -0,0 +1,235 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRangeClient serves ranged GetObject requests from an in-memory object.
+// breakAfter makes the first read of each listed range start fail after the
+// given number of bytes, getErr fails every request and stall makes requests
+// wait until they are canceled.
+type fakeRangeClient struct {
+	*mockOSSClient
+
+	data       []byte
+	breakAfter map[int64]int
+	getErr     error
+	stall      bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeRangeClient) GetObject(ctx context.Context, request *ossv2.GetObjectRequest, optFns ...func(*ossv2.Options)) (*ossv2.GetObjectResult, error) {
+	if f.stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rangeHeader := ossv2.ToString(request.Range)
+	f.requests = append(f.requests, rangeHeader)
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+
+	var start, end int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = bytes.NewReader(f.data[start : end+1])
+	if n, ok := f.breakAfter[start]; ok {
+		delete(f.breakAfter, start)
+		body = io.MultiReader(io.LimitReader(body, int64(n)), &failingReader{err: errors.New("connection reset by peer")})
+	}
+	return &ossv2.GetObjectResult{Body: io.NopCloser(body)}, nil
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func newTestObject(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestRangeReader(t *testing.T) {
+	data := newTestObject(10*1024 + 3)
+
+	client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: data}
+	reader := newRangeReader(newTestLogger(), client, "bucket", "key", "etag", int64(len(data)), 1024, 3, nil)
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Len(t, client.requests, 11)
+}
+
+func TestRangeReader_ResumesBrokenRange(t *testing.T) {
+	data := newTestObject(4 * 1024)
+
+	client := &fakeRangeClient{
+		mockOSSClient: new(mockOSSClient),
+		data:          data,
+		breakAfter:    map[int64]int{2048: 100},
+	}
+	reader := newRangeReader(newTestLogger(), client, "bucket", "key", "etag", int64(len(data)), 1024, 2, nil)
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Contains(t, client.requests, "bytes=2148-3071", "broken range should resume from its last received byte")
+}
+
+func TestRangeReader_Errors(t *testing.T) {
+	tests := []struct {
+		name             string
+		getErr           error
+		expectedRequests int
+		expectedError    string
+	}{
+		{
+			name:             "network errors are retried",
+			getErr:           errors.New("i/o timeout"),
+			expectedRequests: maxRangeRetries + 1,
+			expectedError:    "failed to read bytes 0-1023 of object key: i/o timeout",
+		},
+		{
+			name:             "object changed is not retried",
+			getErr:           &ossv2.ServiceError{StatusCode: 412, Code: "PreconditionFailed"},
+			expectedRequests: 1,
+			expectedError:    "PreconditionFailed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), getErr: tc.getErr}
+			reader := newRangeReader(newTestLogger(), client, "bucket", "key", "etag", 1024, 1024, 1, nil)
+			defer reader.Close()
+
+			_, err := io.ReadAll(reader)
+			assert.ErrorContains(t, err, tc.expectedError)
+			assert.Len(t, client.requests, tc.expectedRequests)
+		})
+	}
+}
+
+func TestRangeReader_TransferTimeout(t *testing.T) {
+	client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), stall: true}
+	reader := newRangeReader(newTestLogger(), client, "bucket", "key", "etag", 1024, 1024, 1, &retryPolicy{transferTimeout: 10 * time.Millisecond})
+	defer reader.Close()
+
+	_, err := io.ReadAll(reader)
+	assert.EqualError(t, err, "failed to read object key in bucket bucket: timed out after 10ms, increase transferTimeout if needed: context deadline exceeded")
+}
+
+func TestRangeReader_VerifiesCRC64(t *testing.T) {
+	data := newTestObject(3000)
+	crc := strconv.FormatUint(crc64.Checksum(data, crc64Table), 10)
+
+	tests := []struct {
+		name          string
+		expectedCRC   *string
+		expectedError string
+	}{
+		{
+			name:        "matching checksum",
+			expectedCRC: ossv2.Ptr(crc),
+		},
+		{
+			name: "no checksum from OSS",
+		},
+		{
+			name:          "corrupted object",
+			expectedCRC:   ossv2.Ptr("12345"),
+			expectedError: "object key in bucket bucket is corrupted: CRC64 is " + crc + ", expected 12345",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: data}
+			reader := newRangeReader(newTestLogger(), client, "bucket", "key", "etag", int64(len(data)), 1024, 2, nil)
+			defer reader.Close()
+			reader.expectCRC64(tc.expectedCRC)
+
+			got, err := io.ReadAll(reader)
+			if tc.expectedError != "" {
+				var mismatch *checksumMismatchError
+				require.ErrorAs(t, err, &mismatch)
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestGetObject(t *testing.T) {
+	data := newTestObject(3000)
+
+	client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: data}
+	client.On("HeadObject", mock.Anything, mock.Anything).Return(&ossv2.HeadObjectResult{
+		ContentLength: int64(len(data)),
+		ETag:          ossv2.Ptr("\"etag\""),
+		HashCRC64:     ossv2.Ptr(strconv.FormatUint(crc64.Checksum(data, crc64Table), 10)),
+	}, nil)
+
+	o := &ObjectStore{
+		log:                 newTestLogger(),
+		client:              client,
+		downloadRangeSize:   1024,
+		downloadConcurrency: 2,
+	}
+
+	body, err := o.GetObject("bucket", "key")
+	require.NoError(t, err)
+	defer body.Close()
+
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.ElementsMatch(t, []string{"bytes=0-1023", "bytes=1024-2047", "bytes=2048-2999"}, client.requests)
+}
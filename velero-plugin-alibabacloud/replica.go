@@ -0,0 +1,81 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// replicaConfigKeys are the config keys of the replica bucket
+var replicaConfigKeys = []string{
+	replicaBucketConfigKey,
+	replicaRegionConfigKey,
+	replicaEndpointConfigKey,
+	replicaCredentialsFileConfigKey,
+}
+
+// replica is a copy of the primary bucket, kept by bucket replication, that
+// objects are read from when the primary bucket is unavailable
+type replica struct {
+	log    logrus.FieldLogger
+	store  *ObjectStore
+	bucket string
+}
+
+// newReplica creates the replica bucket configured by the replica config keys,
+// or returns nil when no replica is configured
+func newReplica(log logrus.FieldLogger, config map[string]string) (*replica, error) {
+	bucket := config[replicaBucketConfigKey]
+	if bucket == "" {
+		for _, key := range replicaConfigKeys {
+			if config[key] != "" {
+				return nil, errors.Errorf("config key %s requires %s", key, replicaBucketConfigKey)
+			}
+		}
+		return nil, nil
+	}
+
+	// The replica is only read, so checks that write to it or change it are left out
+	replicaConfig := secondaryConfig(config, bucket, config[replicaRegionConfigKey],
+		config[replicaEndpointConfigKey], config[replicaCredentialsFileConfigKey])
+	delete(replicaConfig, preflightCheckConfigKey)
+	delete(replicaConfig, wormRetentionDaysConfigKey)
+	delete(replicaConfig, wormConfigurePolicyConfigKey)
+
+	log = log.WithField("replicaBucket", bucket)
+	store := newObjectStore(log)
+	if err := store.Init(replicaConfig); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize replica bucket %s", bucket)
+	}
+	return &replica{log: log, store: store, bucket: bucket}, nil
+}
+
+// readWithFallback reads from the primary bucket with read, and from the replica
+// bucket when the primary bucket is unavailable because of a network or server
+// error. Other errors, such as a missing object or permission, are returned as is.
+func readWithFallback[T any](o *ObjectStore, bucket, action string, read func(store *ObjectStore, bucket string) (T, error)) (T, error) {
+	result, err := read(o, bucket)
+	if o.replica == nil || !isUnavailableError(err) {
+		return result, err
+	}
+
+	o.log.Warnf("failed to %s in bucket %s, falling back to replica bucket %s: %v", action, bucket, o.replica.bucket, err)
+	result, replicaErr := read(o.replica.store, o.replica.bucket)
+	if replicaErr != nil {
+		return result, errors.Wrapf(replicaErr, "failed to %s in replica bucket %s after bucket %s failed with: %v",
+			action, o.replica.bucket, bucket, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReplica(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+
+	r, err := newReplica(newTestLogger(), map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	_, err = newReplica(newTestLogger(), map[string]string{replicaEndpointConfigKey: "https://oss-cn-shanghai.aliyuncs.com"})
+	assert.EqualError(t, err, "config key replicaEndpoint requires replicaBucket")
+
+	r, err = newReplica(newTestLogger(), map[string]string{
+		"bucket":               "primary",
+		regionConfigKey:        "cn-beijing",
+		notOnECSConfigKey:      "true",
+		mirrorBucketConfigKey:  "mirror",
+		replicaBucketConfigKey: "replica",
+		replicaRegionConfigKey: "cn-shanghai",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "replica", r.bucket)
+	assert.Equal(t, "cn-shanghai", r.store.region)
+	assert.Equal(t, "https://oss-cn-shanghai.aliyuncs.com", r.store.endpoint)
+	assert.Nil(t, r.store.mirror)
+	assert.Nil(t, r.store.replica)
+}
+
+func TestIsUnavailableError(t *testing.T) {
+	assert.True(t, isUnavailableError(&ossv2.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"}))
+	assert.True(t, isUnavailableError(errors.Wrap(errors.New("dial tcp 10.0.0.1:443: connect: connection refused"), "failed to list objects")))
+	assert.True(t, isUnavailableError(context.DeadlineExceeded))
+	assert.False(t, isUnavailableError(&ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"}))
+	assert.False(t, isUnavailableError(&ossv2.ServiceError{StatusCode: 404, Code: "NoSuchKey"}))
+	assert.False(t, isUnavailableError(context.Canceled))
+	assert.False(t, isUnavailableError(nil))
+}
+
+func TestReplica_ListObjects(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryErr    error
+		replicaErr    error
+		expectedKeys  []string
+		expectedError string
+	}{
+		{
+			name:         "primary bucket is listed",
+			expectedKeys: []string{"backups/primary"},
+		},
+		{
+			name:         "server error falls back to the replica",
+			primaryErr:   &ossv2.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"},
+			expectedKeys: []string{"backups/replica"},
+		},
+		{
+			name:         "network error falls back to the replica",
+			primaryErr:   errors.Wrap(&net.DNSError{Err: "i/o timeout", Name: "oss-cn-beijing.aliyuncs.com", IsTimeout: true}, "operation error ListObjectsV2"),
+			expectedKeys: []string{"backups/replica"},
+		},
+		{
+			name:          "client error does not fall back",
+			primaryErr:    &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"},
+			expectedError: "failed to list objects with prefix backups/ in bucket primary",
+		},
+		{
+			name:          "replica failure names both errors",
+			primaryErr:    &ossv2.ServiceError{StatusCode: 502, Code: "BadGateway"},
+			replicaErr:    &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"},
+			expectedError: "failed to list objects under backups/ in replica bucket replica after bucket primary failed with",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newClient := func(key string, err error) *mockOSSClient {
+				client := new(mockOSSClient)
+				client.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&ossv2.ListObjectsV2Result{
+					Contents: []ossv2.ObjectProperties{{Key: ossv2.Ptr(key)}},
+				}, err)
+				return client
+			}
+			primaryClient, replicaClient := newClient("backups/primary", tc.primaryErr), newClient("backups/replica", tc.replicaErr)
+
+			o := &ObjectStore{
+				log:    newTestLogger(),
+				client: primaryClient,
+				replica: &replica{
+					log:    newTestLogger(),
+					store:  &ObjectStore{log: newTestLogger(), client: replicaClient},
+					bucket: "replica",
+				},
+			}
+
+			keys, err := o.ListObjects("primary", "backups/")
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedKeys, keys)
+			if tc.primaryErr == nil {
+				replicaClient.AssertNotCalled(t, "ListObjectsV2", mock.Anything, mock.Anything)
+			} else {
+				replicaClient.AssertCalled(t, "ListObjectsV2", mock.Anything, mock.MatchedBy(func(req *ossv2.ListObjectsV2Request) bool {
+					return ossv2.ToString(req.Bucket) == "replica" && ossv2.ToString(req.Prefix) == "backups/"
+				}))
+			}
+		})
+	}
+}
+
+func TestReplica_Reads(t *testing.T) {
+	unavailable := &ossv2.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"}
+	content := newTestObject(1024)
+
+	primaryClient := new(mockOSSClient)
+	primaryClient.On("HeadObject", mock.Anything, mock.Anything).Return(nil, unavailable)
+	primaryClient.On("ListObjectsV2", mock.Anything, mock.Anything).Return(nil, unavailable)
+
+	replicaClient := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: content}
+	replicaClient.On("HeadObject", mock.Anything, mock.MatchedBy(func(req *ossv2.HeadObjectRequest) bool {
+		return ossv2.ToString(req.Bucket) == "replica"
+	})).Return(&ossv2.HeadObjectResult{ContentLength: int64(len(content)), ETag: ossv2.Ptr("etag")}, nil)
+	replicaClient.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&ossv2.ListObjectsV2Result{
+		CommonPrefixes: []ossv2.CommonPrefix{{Prefix: ossv2.Ptr("backups/backup-1/")}},
+	}, nil)
+
+	o := &ObjectStore{
+		log:    newTestLogger(),
+		client: primaryClient,
+		replica: &replica{
+			log: newTestLogger(),
+			store: &ObjectStore{
+				log:                 newTestLogger(),
+				client:              replicaClient,
+				downloadRangeSize:   defaultDownloadRangeSize,
+				downloadConcurrency: 1,
+			},
+			bucket: "replica",
+		},
+	}
+
+	exists, err := o.ObjectExists("primary", "backups/backup-1/velero-backup.json")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	body, err := o.GetObject("primary", "backups/backup-1/velero-backup.json")
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	prefixes, err := o.ListCommonPrefixes("primary", "backups/", "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/backup-1/"}, prefixes)
+}
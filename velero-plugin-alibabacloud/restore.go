@@ -0,0 +1,153 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultRestoreTimeout is how long GetObject waits for an archived backup
+	// to be restored when restoreTimeout is not configured. By default it
+	// requests the restore and fails, so the read can be retried later.
+	defaultRestoreTimeout = 0
+
+	// defaultRestorePollInterval is how often the restore status is checked
+	defaultRestorePollInterval = time.Minute
+
+	// restoreDays is how long a restored copy of an archived object stays readable
+	restoreDays = 1
+)
+
+// getStorageClass returns the storage class for uploaded objects, or an empty
+// string to use the default storage class of the bucket
+func getStorageClass(config map[string]string) (ossv2.StorageClassType, error) {
+	value := config[storageClassConfigKey]
+	if value == "" {
+		return "", nil
+	}
+
+	for _, class := range []ossv2.StorageClassType{
+		ossv2.StorageClassStandard,
+		ossv2.StorageClassIA,
+		ossv2.StorageClassArchive,
+		ossv2.StorageClassColdArchive,
+		ossv2.StorageClassDeepColdArchive,
+	} {
+		if strings.EqualFold(value, string(class)) {
+			return class, nil
+		}
+	}
+	return "", errors.Errorf("invalid value %q for config key %s: must be one of Standard, IA, Archive, ColdArchive or DeepColdArchive",
+		value, storageClassConfigKey)
+}
+
+// isArchiveClass reports whether objects of the storage class have to be restored
+// before they can be read
+func isArchiveClass(class ossv2.StorageClassType) bool {
+	switch class {
+	case ossv2.StorageClassArchive, ossv2.StorageClassColdArchive, ossv2.StorageClassDeepColdArchive:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBackupContents reports whether the key is the contents tarball of a backup,
+// <prefix>/backups/<name>/<name>.tar.gz. The other objects Velero stores are
+// metadata it reads outside of restores, such as logs and backup descriptions.
+func isBackupContents(key string) bool {
+	dir := path.Dir(key)
+	return path.Base(key) == path.Base(dir)+".tar.gz" && path.Base(path.Dir(dir)) == "backups"
+}
+
+// objectStorageClass returns the storage class to upload the object with. Archive
+// classes only apply to backup contents, so that metadata stays readable.
+func (o *ObjectStore) objectStorageClass(key string) ossv2.StorageClassType {
+	if isArchiveClass(o.storageClass) && !isBackupContents(key) {
+		return ""
+	}
+	return o.storageClass
+}
+
+// isArchived reports whether an object is in an archive storage class and has to be
+// restored before it can be read. Restore is set once a restore has been requested,
+// and reads ongoing-request="false" when the restored copy is available.
+func isArchived(head *ossv2.HeadObjectResult) bool {
+	if !isArchiveClass(ossv2.StorageClassType(ossv2.ToString(head.StorageClass))) {
+		return false
+	}
+	return !strings.Contains(ossv2.ToString(head.Restore), `ongoing-request="false"`)
+}
+
+// restoreObject requests the restore of an archived object, unless one is already
+// in progress. Backup contents are waited for until restoreTimeout expires, any
+// other object fails right away so that its read is retried later instead of
+// blocking the caller. It returns the object metadata once the object is readable.
+func (o *ObjectStore) restoreObject(bucket, key string, head *ossv2.HeadObjectResult) (*ossv2.HeadObjectResult, error) {
+	storageClass := ossv2.ToString(head.StorageClass)
+	if head.Restore == nil {
+		o.log.Infof("object %s in bucket %s is in storage class %s, requesting restore", key, bucket, storageClass)
+		ctx, cancel := o.retry.requestContext()
+		_, err := o.client.RestoreObject(ctx, &ossv2.RestoreObjectRequest{
+			Bucket:         ossv2.Ptr(bucket),
+			Key:            ossv2.Ptr(key),
+			RestoreRequest: &ossv2.RestoreRequest{Days: restoreDays},
+		})
+		cancel()
+		var serviceErr *ossv2.ServiceError
+		if err != nil && !(errors.As(err, &serviceErr) && serviceErr.Code == "RestoreAlreadyInProgress") {
+			return nil, errors.Wrapf(err, "failed to restore object %s in bucket %s", key, bucket)
+		}
+	} else {
+		o.log.Infof("restore of object %s in bucket %s (storage class %s) is already in progress", key, bucket, storageClass)
+	}
+
+	if o.restoreTimeout <= 0 || !isBackupContents(key) {
+		return nil, errors.Errorf("restore of object %s in bucket %s (storage class %s) is in progress, retry later",
+			key, bucket, storageClass)
+	}
+
+	start := time.Now()
+	deadline := start.Add(o.restoreTimeout)
+	for {
+		if !time.Now().Before(deadline) {
+			return nil, errors.Errorf("timed out after %s waiting for restore of object %s in bucket %s (storage class %s), retry later or increase %s",
+				o.restoreTimeout, key, bucket, storageClass, restoreTimeoutConfigKey)
+		}
+		o.log.Infof("waiting for restore of object %s in bucket %s, %s elapsed", key, bucket, time.Since(start).Round(time.Second))
+
+		time.Sleep(min(o.restorePollInterval, time.Until(deadline)))
+
+		ctx, cancel := o.retry.requestContext()
+		var err error
+		head, err = o.client.HeadObject(ctx, &ossv2.HeadObjectRequest{
+			Bucket: ossv2.Ptr(bucket),
+			Key:    ossv2.Ptr(key),
+		})
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check restore status of object %s in bucket %s", key, bucket)
+		}
+		if !isArchived(head) {
+			o.log.Infof("object %s in bucket %s restored after %s", key, bucket, time.Since(start).Round(time.Second))
+			return head, nil
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStorageClass(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      ossv2.StorageClassType
+		expectedError string
+	}{
+		{name: "bucket default", value: "", expected: ""},
+		{name: "IA", value: "IA", expected: ossv2.StorageClassIA},
+		{name: "case insensitive", value: "coldarchive", expected: ossv2.StorageClassColdArchive},
+		{name: "invalid", value: "Glacier", expectedError: "invalid value \"Glacier\" for config key storageClass"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			storageClass, err := getStorageClass(map[string]string{storageClassConfigKey: tc.value})
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, storageClass)
+		})
+	}
+}
+
+func TestIsArchived(t *testing.T) {
+	tests := []struct {
+		name         string
+		storageClass string
+		restore      *string
+		expected     bool
+	}{
+		{name: "standard", storageClass: "Standard", expected: false},
+		{name: "IA", storageClass: "IA", expected: false},
+		{name: "archive not restored", storageClass: "Archive", expected: true},
+		{name: "archive restoring", storageClass: "Archive", restore: ossv2.Ptr(`ongoing-request="true"`), expected: true},
+		{name: "cold archive restored", storageClass: "ColdArchive", restore: ossv2.Ptr(`ongoing-request="false", expiry-date="Sun, 16 Apr 2017 08:12:33 GMT"`), expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			head := &ossv2.HeadObjectResult{StorageClass: ossv2.Ptr(tc.storageClass), Restore: tc.restore}
+			assert.Equal(t, tc.expected, isArchived(head))
+		})
+	}
+}
+
+func TestIsBackupContents(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected bool
+	}{
+		{key: "backups/b1/b1.tar.gz", expected: true},
+		{key: "prefix/backups/b1/b1.tar.gz", expected: true},
+		{key: "backups/b1/b1-logs.gz", expected: false},
+		{key: "backups/b1/velero-backup.json", expected: false},
+		{key: "restores/r1/b1.tar.gz", expected: false},
+		{key: "b1/b1.tar.gz", expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isBackupContents(tc.key))
+		})
+	}
+}
+
+func TestPutObjectStorageClass(t *testing.T) {
+	tests := []struct {
+		name         string
+		storageClass ossv2.StorageClassType
+		key          string
+		expected     ossv2.StorageClassType
+	}{
+		{name: "archive backup contents", storageClass: ossv2.StorageClassArchive, key: "backups/b1/b1.tar.gz", expected: ossv2.StorageClassArchive},
+		{name: "archive metadata uses bucket default", storageClass: ossv2.StorageClassColdArchive, key: "backups/b1/velero-backup.json", expected: ""},
+		{name: "IA metadata", storageClass: ossv2.StorageClassIA, key: "backups/b1/b1-logs.gz", expected: ossv2.StorageClassIA},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := new(mockOSSClient)
+			defer client.AssertExpectations(t)
+			client.On("PutObject", mock.Anything, mock.MatchedBy(func(req *ossv2.PutObjectRequest) bool {
+				return req.StorageClass == tc.expected
+			})).Return(&ossv2.PutObjectResult{}, nil)
+
+			o := &ObjectStore{client: client, storageClass: tc.storageClass, uploadPartSize: ossv2.MinPartSize}
+			assert.NoError(t, o.PutObject("bucket", tc.key, bytes.NewReader([]byte("data"))))
+		})
+	}
+}
+
+func TestGetObject_ArchivedObject(t *testing.T) {
+	data := newTestObject(100)
+	archived := &ossv2.HeadObjectResult{ContentLength: 100, StorageClass: ossv2.Ptr("Archive")}
+	restoring := &ossv2.HeadObjectResult{ContentLength: 100, StorageClass: ossv2.Ptr("Archive"), Restore: ossv2.Ptr(`ongoing-request="true"`)}
+	restored := &ossv2.HeadObjectResult{ContentLength: 100, StorageClass: ossv2.Ptr("Archive"), Restore: ossv2.Ptr(`ongoing-request="false", expiry-date="Sun, 16 Apr 2017 08:12:33 GMT"`)}
+
+	tests := []struct {
+		name           string
+		key            string
+		restoreTimeout time.Duration
+		setupMock      func(client *mockOSSClient)
+		expectedError  string
+	}{
+		{
+			name:           "restore is requested and awaited",
+			key:            "backups/b1/b1.tar.gz",
+			restoreTimeout: 50 * time.Millisecond,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(archived, nil).Once()
+				client.On("RestoreObject", mock.Anything, mock.MatchedBy(func(req *ossv2.RestoreObjectRequest) bool {
+					return ossv2.ToString(req.Key) == "backups/b1/b1.tar.gz" && req.RestoreRequest.Days == restoreDays
+				})).Return(&ossv2.RestoreObjectResult{}, nil).Once()
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restoring, nil).Twice()
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restored, nil).Once()
+			},
+		},
+		{
+			name:           "restore already in progress is awaited",
+			key:            "backups/b1/b1.tar.gz",
+			restoreTimeout: 50 * time.Millisecond,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restoring, nil).Once()
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restored, nil).Once()
+			},
+		},
+		{
+			name:           "concurrent restore request is tolerated",
+			key:            "backups/b1/b1.tar.gz",
+			restoreTimeout: 50 * time.Millisecond,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(archived, nil).Once()
+				client.On("RestoreObject", mock.Anything, mock.Anything).
+					Return(nil, &ossv2.ServiceError{StatusCode: 409, Code: "RestoreAlreadyInProgress"}).Once()
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restored, nil).Once()
+			},
+		},
+		{
+			name:           "restore request fails",
+			key:            "backups/b1/b1.tar.gz",
+			restoreTimeout: 50 * time.Millisecond,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(archived, nil).Once()
+				client.On("RestoreObject", mock.Anything, mock.Anything).
+					Return(nil, &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"}).Once()
+			},
+			expectedError: "failed to restore object backups/b1/b1.tar.gz in bucket bucket",
+		},
+		{
+			name:           "restore times out",
+			key:            "backups/b1/b1.tar.gz",
+			restoreTimeout: 50 * time.Millisecond,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restoring, nil)
+			},
+			expectedError: "waiting for restore of object backups/b1/b1.tar.gz in bucket bucket (storage class Archive), retry later or increase restoreTimeout",
+		},
+		{
+			name: "restore is requested without waiting by default",
+			key:  "backups/b1/b1.tar.gz",
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(archived, nil).Once()
+				client.On("RestoreObject", mock.Anything, mock.Anything).Return(&ossv2.RestoreObjectResult{}, nil).Once()
+			},
+			expectedError: "restore of object backups/b1/b1.tar.gz in bucket bucket (storage class Archive) is in progress, retry later",
+		},
+		{
+			name:           "metadata is not waited for",
+			key:            "backups/b1/velero-backup.json",
+			restoreTimeout: time.Hour,
+			setupMock: func(client *mockOSSClient) {
+				client.On("HeadObject", mock.Anything, mock.Anything).Return(restoring, nil).Once()
+			},
+			expectedError: "restore of object backups/b1/velero-backup.json in bucket bucket (storage class Archive) is in progress, retry later",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeRangeClient{mockOSSClient: new(mockOSSClient), data: data}
+			tc.setupMock(client.mockOSSClient)
+
+			o := &ObjectStore{
+				log:                 newTestLogger(),
+				client:              client,
+				downloadRangeSize:   1024,
+				downloadConcurrency: 1,
+				restoreTimeout:      tc.restoreTimeout,
+				restorePollInterval: time.Millisecond,
+			}
+
+			body, err := o.GetObject("bucket", tc.key)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				client.AssertExpectations(t)
+				return
+			}
+			require.NoError(t, err)
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			client.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/retry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// The defaults match those of the OSS and ECS SDKs
+	defaultMaxRetries       = 2
+	defaultRetryBaseDelay   = 200 * time.Millisecond
+	defaultRetryMaxDelay    = 20 * time.Second
+	defaultConnectTimeout   = 5 * time.Second
+	defaultReadWriteTimeout = 10 * time.Second
+
+	// defaultRequestTimeout bounds a metadata operation, retries included
+	defaultRequestTimeout = 2 * time.Minute
+)
+
+// retryPolicy holds the retry and timeout settings shared by the OSS and ECS
+// clients of a location
+type retryPolicy struct {
+	maxRetries       int           // Retries after the first attempt
+	baseDelay        time.Duration // Backoff before the first retry, doubled on every retry
+	maxDelay         time.Duration // Upper bound of the backoff
+	connectTimeout   time.Duration // Timeout of establishing a connection
+	readWriteTimeout time.Duration // Timeout of reading or writing on an established connection
+	requestTimeout   time.Duration // Deadline of a metadata operation, retries included
+	transferTimeout  time.Duration // Deadline of uploading or downloading an object, 0 for none
+
+	backoff *retry.FullJitterBackoff
+}
+
+// getRetryPolicy returns the retry policy from config
+func getRetryPolicy(config map[string]string) (*retryPolicy, error) {
+	maxRetries := defaultMaxRetries
+	if value := strings.TrimSpace(config[maxRetriesConfigKey]); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid value %q for config key %s: must be a non-negative integer", value, maxRetriesConfigKey)
+		}
+		maxRetries = n
+	}
+
+	p := &retryPolicy{maxRetries: maxRetries}
+	var err error
+	for _, d := range []struct {
+		key          string
+		value        *time.Duration
+		defaultValue time.Duration
+	}{
+		{retryBaseDelayConfigKey, &p.baseDelay, defaultRetryBaseDelay},
+		{retryMaxDelayConfigKey, &p.maxDelay, defaultRetryMaxDelay},
+		{connectTimeoutConfigKey, &p.connectTimeout, defaultConnectTimeout},
+		{readWriteTimeoutConfigKey, &p.readWriteTimeout, defaultReadWriteTimeout},
+		{requestTimeoutConfigKey, &p.requestTimeout, defaultRequestTimeout},
+		{transferTimeoutConfigKey, &p.transferTimeout, 0},
+	} {
+		if *d.value, err = getConfigDuration(config, d.key, d.defaultValue); err != nil {
+			return nil, err
+		}
+	}
+	if p.maxDelay < p.baseDelay {
+		return nil, errors.Errorf("config key %s must not be smaller than %s", retryMaxDelayConfigKey, retryBaseDelayConfigKey)
+	}
+
+	p.backoff = retry.NewFullJitterBackoff(p.baseDelay, p.maxDelay)
+	return p, nil
+}
+
+// MaxAttempts implements retry.Retryer for the OSS client
+func (p *retryPolicy) MaxAttempts() int {
+	return p.maxRetries + 1
+}
+
+// IsErrorRetryable implements retry.Retryer for the OSS client. OSS requests
+// are idempotent, so every retryable error class is retried.
+func (p *retryPolicy) IsErrorRetryable(err error) bool {
+	return isRetryableError(err)
+}
+
+// RetryDelay implements retry.Retryer for the OSS client, it returns a full
+// jitter exponential backoff
+func (p *retryPolicy) RetryDelay(attempt int, err error) (time.Duration, error) {
+	return p.backoff.BackoffDelay(attempt, err)
+}
+
+// requestContext returns a context bounded by the request timeout, for
+// operations whose duration does not depend on the size of an object
+func (p *retryPolicy) requestContext() (context.Context, context.CancelFunc) {
+	if p == nil {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.requestTimeout)
+}
+
+// transferContext returns a context bounded by the transfer timeout, if any, for
+// uploading or downloading the content of an object. A stalled transfer is
+// already failed by the read/write timeout.
+func (p *retryPolicy) transferContext() (context.Context, context.CancelFunc) {
+	if p == nil || p.transferTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.transferTimeout)
+}
+
+// transferError explains err if the transfer timeout of ctx expired
+func (p *retryPolicy) transferError(ctx context.Context, err error) error {
+	if p == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return errors.Wrapf(err, "timed out after %s, increase %s if needed", p.transferTimeout, transferTimeoutConfigKey)
+}
+
+// do calls fn until it succeeds, fails with an error that is not safe to retry,
+// runs out of attempts or exceeds the request timeout. fn is given the read
+// timeout of its attempt. Calls that are not idempotent are retried only when
+// the service did not process the request.
+func (p *retryPolicy) do(log logrus.FieldLogger, action string, idempotent bool, fn func(readTimeout time.Duration) error) error {
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	retryable := isRejectedError
+	if idempotent {
+		retryable = isRetryableError
+	}
+
+	for attempt := 1; ; attempt++ {
+		readTimeout := p.readWriteTimeout
+		if remaining := time.Until(deadline); remaining < readTimeout {
+			readTimeout = remaining
+		}
+		err := fn(readTimeout)
+		if err == nil || attempt >= p.MaxAttempts() || !retryable(err) {
+			return err
+		}
+
+		delay, _ := p.RetryDelay(attempt, err)
+		if time.Until(deadline) <= delay {
+			return errors.Wrapf(err, "%s timed out after %d attempts", action, attempt)
+		}
+		log.Warnf("%s failed, retrying in %s (attempt %d of %d): %v", action, delay, attempt, p.MaxAttempts(), err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(err, "%s timed out after %d attempts", action, attempt)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// getErrorStatus returns the HTTP status code and error code of a service error
+// returned by the OSS or OpenAPI SDKs, ok is false for other errors
+func getErrorStatus(err error) (status int, code string, ok bool) {
+	var ossErr interface {
+		HttpStatusCode() int
+		ErrorCode() string
+	}
+	if errors.As(err, &ossErr) {
+		return ossErr.HttpStatusCode(), ossErr.ErrorCode(), true
+	}
+	var teaErr *tea.SDKError
+	if errors.As(err, &teaErr) {
+		return tea.IntValue(teaErr.StatusCode), tea.StringValue(teaErr.Code), true
+	}
+	var apiErr interface {
+		GetStatusCode() *int
+		GetCode() *string
+	}
+	if errors.As(err, &apiErr) {
+		return tea.IntValue(apiErr.GetStatusCode()), tea.StringValue(apiErr.GetCode()), true
+	}
+	return 0, "", false
+}
+
+// isThrottled returns whether the service rejected the request because of flow
+// control or clock skew. Such requests were not processed.
+func isThrottled(status int, code string) bool {
+	// The OSS client corrects its clock offset before retrying RequestTimeTooSkewed
+	return status == 429 || strings.HasPrefix(code, "Throttling") || code == "RequestTimeTooSkewed"
+}
+
+// isRetryableError returns whether an idempotent request failed with an error
+// that is safe to retry: throttling, server errors, request timeouts and
+// connection errors. Client errors such as invalid parameters, missing
+// permissions or missing resources are never retried.
+func isRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if status, code, ok := getErrorStatus(err); ok && status > 0 {
+		return isThrottled(status, code) || status >= 500 || status == 408
+	}
+	return (&retry.ConnectionErrorRetryable{}).IsErrorRetryable(err)
+}
+
+// isUnavailableError returns whether a request failed because the service could
+// not be reached, timed out or failed on the server side, as during an outage
+func isUnavailableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if status, _, ok := getErrorStatus(err); ok && status > 0 {
+		return status >= 500
+	}
+	// The SDK wraps the network errors, which its own check does not unwrap
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return (&retry.ConnectionErrorRetryable{}).IsErrorRetryable(err)
+}
+
+// isRejectedError returns whether a request failed before the service could
+// process it, which makes retrying safe even if the request is not idempotent
+func isRejectedError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if status, code, ok := getErrorStatus(err); ok && status > 0 {
+		return isThrottled(status, code)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection refused")
+}
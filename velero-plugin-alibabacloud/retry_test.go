@@ -0,0 +1,405 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expected      *retryPolicy
+		expectedError string
+	}{
+		{
+			name:   "defaults",
+			config: map[string]string{},
+			expected: &retryPolicy{
+				maxRetries:       defaultMaxRetries,
+				baseDelay:        defaultRetryBaseDelay,
+				maxDelay:         defaultRetryMaxDelay,
+				connectTimeout:   defaultConnectTimeout,
+				readWriteTimeout: defaultReadWriteTimeout,
+				requestTimeout:   defaultRequestTimeout,
+			},
+		},
+		{
+			name: "custom values",
+			config: map[string]string{
+				maxRetriesConfigKey:       "5",
+				retryBaseDelayConfigKey:   "1s",
+				retryMaxDelayConfigKey:    "1m",
+				connectTimeoutConfigKey:   "3s",
+				readWriteTimeoutConfigKey: "30s",
+				requestTimeoutConfigKey:   "10m",
+				transferTimeoutConfigKey:  "1h",
+			},
+			expected: &retryPolicy{
+				maxRetries:       5,
+				baseDelay:        time.Second,
+				maxDelay:         time.Minute,
+				connectTimeout:   3 * time.Second,
+				readWriteTimeout: 30 * time.Second,
+				requestTimeout:   10 * time.Minute,
+				transferTimeout:  time.Hour,
+			},
+		},
+		{
+			name:   "retries can be disabled",
+			config: map[string]string{maxRetriesConfigKey: "0"},
+			expected: &retryPolicy{
+				maxRetries:       0,
+				baseDelay:        defaultRetryBaseDelay,
+				maxDelay:         defaultRetryMaxDelay,
+				connectTimeout:   defaultConnectTimeout,
+				readWriteTimeout: defaultReadWriteTimeout,
+				requestTimeout:   defaultRequestTimeout,
+			},
+		},
+		{
+			name:          "negative max retries",
+			config:        map[string]string{maxRetriesConfigKey: "-1"},
+			expectedError: "must be a non-negative integer",
+		},
+		{
+			name:          "invalid timeout",
+			config:        map[string]string{requestTimeoutConfigKey: "soon"},
+			expectedError: "invalid value \"soon\" for config key requestTimeout",
+		},
+		{
+			name:          "max delay smaller than base delay",
+			config:        map[string]string{retryBaseDelayConfigKey: "10s", retryMaxDelayConfigKey: "1s"},
+			expectedError: "config key retryMaxDelay must not be smaller than retryBaseDelay",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := getRetryPolicy(tc.config)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, policy.backoff)
+			policy.backoff = nil
+			assert.Equal(t, tc.expected, policy)
+		})
+	}
+}
+
+func TestRetryPolicy_TransferContext(t *testing.T) {
+	policy, err := getRetryPolicy(map[string]string{})
+	require.NoError(t, err)
+	ctx, cancel := policy.transferContext()
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok, "transfers have no deadline by default")
+
+	policy, err = getRetryPolicy(map[string]string{transferTimeoutConfigKey: "1h"})
+	require.NoError(t, err)
+	ctx, cancel = policy.transferContext()
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		rejected  bool
+	}{
+		{
+			name:      "OSS throttling",
+			err:       &ossv2.ServiceError{StatusCode: 503, Code: "Throttling"},
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name:      "OSS too many requests",
+			err:       errors.Wrap(&ossv2.ServiceError{StatusCode: 429, Code: "TooManyRequests"}, "failed"),
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name:      "OSS internal error",
+			err:       &ossv2.ServiceError{StatusCode: 500, Code: "InternalError"},
+			retryable: true,
+		},
+		{
+			name:      "OSS request timeout",
+			err:       &ossv2.ServiceError{StatusCode: 408, Code: "RequestTimeout"},
+			retryable: true,
+		},
+		{
+			name:      "OSS clock skew",
+			err:       &ossv2.ServiceError{StatusCode: 403, Code: "RequestTimeTooSkewed"},
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name: "OSS access denied",
+			err:  &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"},
+		},
+		{
+			name: "OSS missing object",
+			err:  &ossv2.ServiceError{StatusCode: 404, Code: "NoSuchKey"},
+		},
+		{
+			name:      "ECS throttling",
+			err:       &tea.SDKError{StatusCode: tea.Int(400), Code: tea.String("Throttling.User")},
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name:      "ECS server error",
+			err:       &tea.SDKError{StatusCode: tea.Int(500), Code: tea.String("InternalError")},
+			retryable: true,
+		},
+		{
+			name: "ECS invalid parameter",
+			err:  &tea.SDKError{StatusCode: tea.Int(400), Code: tea.String("InvalidParameter")},
+		},
+		{
+			name:      "OpenAPI throttling error",
+			err:       &openapi.ThrottlingError{StatusCode: tea.Int(400), Code: tea.String("Throttling.Api")},
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name: "OpenAPI client error",
+			err:  &openapi.ClientError{StatusCode: tea.Int(404), Code: tea.String("InvalidSnapshotId.NotFound")},
+		},
+		{
+			name:      "connection refused",
+			err:       &url.Error{Op: "Post", URL: "https://ecs.aliyuncs.com", Err: &net.OpError{Op: "dial", Err: errors.New("connect: connection refused")}},
+			retryable: true,
+			rejected:  true,
+		},
+		{
+			name:      "connection reset",
+			err:       &url.Error{Op: "Post", URL: "https://ecs.aliyuncs.com", Err: errors.New("read: connection reset by peer")},
+			retryable: true,
+		},
+		{
+			name: "canceled",
+			err:  errors.Wrap(context.Canceled, "failed"),
+		},
+		{
+			name: "deadline exceeded",
+			err:  context.DeadlineExceeded,
+		},
+		{
+			name: "other error",
+			err:  errors.New("invalid response"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.retryable, isRetryableError(tc.err), "retryable")
+			assert.Equal(t, tc.rejected, isRejectedError(tc.err), "rejected")
+		})
+	}
+}
+
+func TestRetryPolicy_Do(t *testing.T) {
+	newPolicy := func(t *testing.T, config map[string]string) *retryPolicy {
+		if config[retryBaseDelayConfigKey] == "" {
+			config[retryBaseDelayConfigKey] = "1ms"
+			config[retryMaxDelayConfigKey] = "2ms"
+		}
+		policy, err := getRetryPolicy(config)
+		require.NoError(t, err)
+		return policy
+	}
+	failing := func(calls *int, errs ...error) func(time.Duration) error {
+		return func(time.Duration) error {
+			*calls++
+			if *calls <= len(errs) {
+				return errs[*calls-1]
+			}
+			return nil
+		}
+	}
+	serverError := &tea.SDKError{StatusCode: tea.Int(503), Code: tea.String("ServiceUnavailable")}
+	throttled := &tea.SDKError{StatusCode: tea.Int(400), Code: tea.String("Throttling")}
+
+	t.Run("idempotent call is retried on server errors", func(t *testing.T) {
+		var calls int
+		err := newPolicy(t, map[string]string{}).do(newTestLogger(), "DescribeDisks", true, failing(&calls, serverError, serverError))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("attempts are limited", func(t *testing.T) {
+		var calls int
+		err := newPolicy(t, map[string]string{maxRetriesConfigKey: "1"}).do(newTestLogger(), "DescribeDisks", true, failing(&calls, serverError, serverError))
+		assert.Same(t, serverError, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("non-idempotent call is not retried on server errors", func(t *testing.T) {
+		var calls int
+		err := newPolicy(t, map[string]string{}).do(newTestLogger(), "CreateDisk", false, failing(&calls, serverError))
+		assert.Same(t, serverError, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("non-idempotent call is retried when throttled", func(t *testing.T) {
+		var calls int
+		err := newPolicy(t, map[string]string{}).do(newTestLogger(), "CreateDisk", false, failing(&calls, throttled))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("retries stop at the request timeout", func(t *testing.T) {
+		policy := newPolicy(t, map[string]string{
+			requestTimeoutConfigKey: "50ms",
+			maxRetriesConfigKey:     "1000",
+			retryBaseDelayConfigKey: "20ms",
+			retryMaxDelayConfigKey:  "20ms",
+		})
+
+		var calls int
+		var readTimeouts []time.Duration
+		start := time.Now()
+		err := policy.do(newTestLogger(), "DescribeDisks", true, func(readTimeout time.Duration) error {
+			calls++
+			readTimeouts = append(readTimeouts, readTimeout)
+			time.Sleep(20 * time.Millisecond)
+			return serverError
+		})
+		assert.ErrorContains(t, err, "DescribeDisks timed out after")
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Less(t, calls, 5)
+		for _, readTimeout := range readTimeouts {
+			assert.LessOrEqual(t, readTimeout, 50*time.Millisecond, "attempts do not outlive the request timeout")
+		}
+	})
+}
+
+func TestEcsClientWrapper_Retry(t *testing.T) {
+	var describeCalls, createCalls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("x-acs-action") {
+		case "DescribeSnapshots":
+			if describeCalls.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `{"Code":"ServiceUnavailable","Message":"busy","RequestId":"1"}`)
+				return
+			}
+			fmt.Fprint(w, `{"RequestId":"2","Snapshots":{"Snapshot":[{"SnapshotId":"s-1"}]}}`)
+		case "CreateSnapshot":
+			createCalls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"Code":"InternalError","Message":"failed","RequestId":"3"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"Code":"InvalidAction","Message":"unknown action","RequestId":"4"}`)
+		}
+	}))
+	defer server.Close()
+
+	credentials := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil)
+	policy, err := getRetryPolicy(map[string]string{retryBaseDelayConfigKey: "1ms", retryMaxDelayConfigKey: "1ms"})
+	require.NoError(t, err)
+	wrapper, err := newEcsClientWrapper(&openapi.Config{
+		Endpoint:   tea.String(strings.TrimPrefix(server.URL, "http://")),
+		Protocol:   tea.String("http"),
+		Credential: &openapiCredential{provider: credentials},
+		RegionId:   tea.String("cn-hangzhou"),
+	}, newTestLogger(), policy)
+	require.NoError(t, err)
+
+	res, err := wrapper.DescribeSnapshots(&ecs20140526.DescribeSnapshotsRequest{RegionId: tea.String("cn-hangzhou")})
+	require.NoError(t, err)
+	assert.Equal(t, "s-1", tea.StringValue(res.Body.Snapshots.Snapshot[0].SnapshotId))
+	assert.Equal(t, int32(2), describeCalls.Load())
+
+	_, err = wrapper.CreateSnapshot(&ecs20140526.CreateSnapshotRequest{DiskId: tea.String("d-1")})
+	assert.ErrorContains(t, err, "InternalError")
+	assert.Equal(t, int32(1), createCalls.Load(), "a snapshot is not created twice")
+}
+
+func TestEcsClientWrapper_ReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-acs-action") == "DescribeDisks" {
+			time.Sleep(3 * time.Second)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"RequestId":"1","Snapshots":{"Snapshot":[{"SnapshotId":"s-1"}]}}`)
+	}))
+	defer server.Close()
+
+	credentials := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "ak", accessKeySecret: "sk"}, nil)
+	policy, err := getRetryPolicy(map[string]string{maxRetriesConfigKey: "0", readWriteTimeoutConfigKey: "1s"})
+	require.NoError(t, err)
+	wrapper, err := newEcsClientWrapper(&openapi.Config{
+		Endpoint:   tea.String(strings.TrimPrefix(server.URL, "http://")),
+		Protocol:   tea.String("http"),
+		Credential: &openapiCredential{provider: credentials},
+		RegionId:   tea.String("cn-hangzhou"),
+	}, newTestLogger(), policy)
+	require.NoError(t, err)
+
+	// A slow request times out, and the requests sent concurrently are served
+	// once it does
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		_, err := wrapper.DescribeDisks(&ecs20140526.DescribeDisksRequest{RegionId: tea.String("cn-hangzhou")})
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	}()
+	for range 5 {
+		res, err := wrapper.DescribeSnapshots(&ecs20140526.DescribeSnapshotsRequest{RegionId: tea.String("cn-hangzhou")})
+		require.NoError(t, err)
+		assert.Equal(t, "s-1", tea.StringValue(res.Body.Snapshots.Snapshot[0].SnapshotId))
+	}
+	wg.Wait()
+}
+
+func TestCeilSeconds(t *testing.T) {
+	assert.Equal(t, int64(0), ceilSeconds(0))
+	assert.Equal(t, int64(1), ceilSeconds(50*time.Millisecond))
+	assert.Equal(t, int64(1), ceilSeconds(time.Second))
+	assert.Equal(t, int64(2), ceilSeconds(1001*time.Millisecond))
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultSnapshotReadyTimeout is how long to wait for a snapshot to be
+	// accomplished when snapshotReadyTimeout is not configured
+	defaultSnapshotReadyTimeout = time.Hour
+
+	// defaultSnapshotPollInterval is how often the snapshot status is checked
+	defaultSnapshotPollInterval = 10 * time.Second
+
+	// Snapshot statuses returned by DescribeSnapshots
+	snapshotStatusAccomplished = "accomplished"
+	snapshotStatusFailed       = "failed"
+)
+
+// waitForSnapshot waits until snapshot is accomplished or snapshotReadyTimeout
+// expires, and returns the accomplished snapshot. With available, a snapshot
+// that is still being uploaded is also returned once ECS reports that disks can
+// be created from it, as instant access snapshots are. A failed snapshot is
+// never going to be usable, so it is reported as an error right away.
+func (b *VolumeSnapshotter) waitForSnapshot(snapshot *ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot, available bool) (*ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot, error) {
+	snapshotID := tea.StringValue(snapshot.SnapshotId)
+	start := time.Now()
+	deadline := start.Add(b.snapshotReadyTimeout)
+	for {
+		status, progress := tea.StringValue(snapshot.Status), tea.StringValue(snapshot.Progress)
+		switch status {
+		case snapshotStatusAccomplished:
+			if waited := time.Since(start); waited >= time.Second {
+				b.log.Infof("snapshot %s accomplished after %s", snapshotID, waited.Round(time.Second))
+			}
+			return snapshot, nil
+		case snapshotStatusFailed:
+			return nil, errors.Errorf("snapshot %s failed at %s progress and cannot be used", snapshotID, progress)
+		}
+		if available && tea.BoolValue(snapshot.Available) {
+			b.log.Infof("snapshot %s is available for instant access at %s progress", snapshotID, progress)
+			return snapshot, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, errors.Errorf("timed out after %s waiting for snapshot %s to be accomplished (status %s, progress %s), increase %s if needed",
+				b.snapshotReadyTimeout, snapshotID, status, progress, snapshotReadyTimeoutConfigKey)
+		}
+		b.log.Infof("waiting for snapshot %s to be accomplished (status %s, progress %s), %s elapsed",
+			snapshotID, status, progress, time.Since(start).Round(time.Second))
+		time.Sleep(min(b.snapshotPollInterval, time.Until(deadline)))
+
+		var err error
+		snapshot, err = b.describeSnapshot(snapshotID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check status of snapshot %s", snapshotID)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// snapshotWithStatus returns a snapshot with the given status and progress
+func snapshotWithStatus(snapshotID, status, progress string) *ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot {
+	return &ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot{
+		SnapshotId: tea.String(snapshotID),
+		Status:     tea.String(status),
+		Progress:   tea.String(progress),
+		Tags:       &ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshotTags{},
+	}
+}
+
+// instantAccessSnapshot returns a snapshot that is being uploaded, and from which
+// disks can already be created
+func instantAccessSnapshot(snapshotID, progress string) *ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot {
+	snapshot := snapshotWithStatus(snapshotID, "progressing", progress)
+	snapshot.InstantAccess = tea.Bool(true)
+	snapshot.Available = tea.Bool(true)
+	return snapshot
+}
+
+// describeSnapshotsResponse returns a DescribeSnapshots response with snapshot
+func describeSnapshotsResponse(snapshot *ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot) *ecs20140526.DescribeSnapshotsResponse {
+	return &ecs20140526.DescribeSnapshotsResponse{
+		Body: &ecs20140526.DescribeSnapshotsResponseBody{
+			Snapshots: &ecs20140526.DescribeSnapshotsResponseBodySnapshots{
+				Snapshot: []*ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot{snapshot},
+			},
+		},
+	}
+}
+
+func TestWaitForSnapshot(t *testing.T) {
+	tests := []struct {
+		name           string
+		snapshot       *ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot
+		available      bool
+		mockSetup      func(*mockECSClient)
+		timeout        time.Duration
+		expectedStatus string
+		expectedError  string
+	}{
+		{
+			name:     "accomplished snapshot is returned right away",
+			snapshot: snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%"),
+			timeout:  time.Minute,
+		},
+		{
+			name:     "progressing snapshot is polled until accomplished",
+			snapshot: snapshotWithStatus("s-123456", "progressing", "10%"),
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", "progressing", "60%")), nil).Once()
+				m.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%")), nil).Once()
+			},
+			timeout: time.Minute,
+		},
+		{
+			name:           "available snapshot is returned while uploaded",
+			snapshot:       instantAccessSnapshot("s-123456", "20%"),
+			available:      true,
+			timeout:        time.Minute,
+			expectedStatus: "progressing",
+		},
+		{
+			name:      "available snapshot is polled until accomplished",
+			snapshot:  instantAccessSnapshot("s-123456", "20%"),
+			available: false,
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusAccomplished, "100%")), nil).Once()
+			},
+			timeout: time.Minute,
+		},
+		{
+			name:          "failed snapshot",
+			snapshot:      snapshotWithStatus("s-123456", snapshotStatusFailed, "30%"),
+			timeout:       time.Minute,
+			expectedError: "snapshot s-123456 failed at 30% progress",
+		},
+		{
+			name:     "snapshot fails while polled",
+			snapshot: snapshotWithStatus("s-123456", "progressing", "10%"),
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusFailed, "40%")), nil).Once()
+			},
+			timeout:       time.Minute,
+			expectedError: "snapshot s-123456 failed at 40% progress",
+		},
+		{
+			name:          "timeout",
+			snapshot:      snapshotWithStatus("s-123456", "progressing", "10%"),
+			expectedError: "waiting for snapshot s-123456 to be accomplished (status progressing, progress 10%), increase snapshotReadyTimeout",
+		},
+		{
+			name:     "describe snapshot fails",
+			snapshot: snapshotWithStatus("s-123456", "progressing", "10%"),
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeSnapshots", mock.Anything).Return(nil, errors.New("throttled")).Once()
+			},
+			timeout:       time.Minute,
+			expectedError: "failed to check status of snapshot s-123456",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+			if test.mockSetup != nil {
+				test.mockSetup(client)
+			}
+
+			b := &VolumeSnapshotter{
+				log:                  newTestLogger(),
+				client:               client,
+				region:               "cn-hangzhou",
+				snapshotReadyTimeout: test.timeout,
+				snapshotPollInterval: time.Millisecond,
+			}
+
+			snapshot, err := b.waitForSnapshot(test.snapshot, test.available)
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				assert.Nil(t, snapshot)
+				return
+			}
+
+			assert.NoError(t, err)
+			if test.expectedStatus == "" {
+				test.expectedStatus = snapshotStatusAccomplished
+			}
+			assert.Equal(t, test.expectedStatus, tea.StringValue(snapshot.Status))
+		})
+	}
+}
+
+func TestCreateSnapshot_WaitForSnapshotReady(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		expectDelete  bool
+		expectedError string
+	}{
+		{
+			name:   "snapshot accomplished",
+			status: snapshotStatusAccomplished,
+		},
+		{
+			name:          "failed snapshot is deleted",
+			status:        snapshotStatusFailed,
+			expectDelete:  true,
+			expectedError: "failed to wait for snapshot s-123456 of volume d-123456: snapshot s-123456 failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(mockECSClient)
+			defer client.AssertExpectations(t)
+
+			client.On("DescribeDisks", mock.Anything).Return(&ecs20140526.DescribeDisksResponse{
+				Body: &ecs20140526.DescribeDisksResponseBody{
+					Disks: &ecs20140526.DescribeDisksResponseBodyDisks{
+						Disk: []*ecs20140526.DescribeDisksResponseBodyDisksDisk{
+							{DiskId: tea.String("d-123456"), Tags: &ecs20140526.DescribeDisksResponseBodyDisksDiskTags{}},
+						},
+					},
+				},
+			}, nil)
+			client.On("CreateSnapshot", mock.Anything).Return(&ecs20140526.CreateSnapshotResponse{
+				Body: &ecs20140526.CreateSnapshotResponseBody{SnapshotId: tea.String("s-123456")},
+			}, nil)
+			client.On("DescribeSnapshots", mock.MatchedBy(func(req *ecs20140526.DescribeSnapshotsRequest) bool {
+				return req.Tag != nil
+			})).Return(&ecs20140526.DescribeSnapshotsResponse{}, nil).Once()
+			client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", "progressing", "50%")), nil).Once()
+			client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", test.status, "100%")), nil).Once()
+			if test.expectDelete {
+				client.On("DeleteSnapshot", mock.MatchedBy(func(req *ecs20140526.DeleteSnapshotRequest) bool {
+					return tea.StringValue(req.SnapshotId) == "s-123456"
+				})).Return(&ecs20140526.DeleteSnapshotResponse{}, nil)
+			}
+
+			b := &VolumeSnapshotter{
+				log:                  newTestLogger(),
+				client:               client,
+				region:               "cn-hangzhou",
+				snapshotReadyTimeout: time.Minute,
+				snapshotPollInterval: time.Millisecond,
+				waitForSnapshotReady: true,
+			}
+
+			snapshotID, err := b.CreateSnapshot("d-123456", "cn-hangzhou-h", map[string]string{})
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				assert.Empty(t, snapshotID)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "s-123456", snapshotID)
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshot_FailedSnapshot(t *testing.T) {
+	client := new(mockECSClient)
+	defer client.AssertExpectations(t)
+
+	client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", "progressing", "90%")), nil).Once()
+	client.On("DescribeSnapshots", mock.Anything).Return(describeSnapshotsResponse(snapshotWithStatus("s-123456", snapshotStatusFailed, "90%")), nil).Once()
+
+	b := &VolumeSnapshotter{
+		log:                  newTestLogger(),
+		client:               client,
+		region:               "cn-hangzhou",
+		snapshotReadyTimeout: time.Minute,
+		snapshotPollInterval: time.Millisecond,
+	}
+
+	volumeID, err := b.CreateVolumeFromSnapshot("s-123456", "cloud_essd", "cn-hangzhou-h", nil)
+	assert.ErrorContains(t, err, "snapshot s-123456 failed at 90% progress")
+	assert.Empty(t, volumeID)
+	client.AssertNotCalled(t, "CreateDisk", mock.Anything)
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/dara"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/aliyun/credentials-go/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	stsDefaultEndpoint = "sts.aliyuncs.com"
+	stsAPIVersion      = "2015-04-01"
+
+	// stsRoleSessionName identifies the plugin in the ActionTrail events of assumed roles
+	stsRoleSessionName = "velero-plugin-alibabacloud"
+
+	// stsSessionDuration is the lifetime requested for assumed role credentials
+	stsSessionDuration = time.Hour
+)
+
+// roleConfig holds the settings used to assume a RAM role, typically in another
+// account, on top of the base credentials of a location
+type roleConfig struct {
+	roleArn         string
+	roleSessionName string
+	externalID      string
+	stsEndpoint     string
+}
+
+// getRoleConfig returns the role to assume from config, or nil if none is configured
+func getRoleConfig(config map[string]string) (*roleConfig, error) {
+	role := &roleConfig{
+		roleArn:         config[roleArnConfigKey],
+		roleSessionName: config[roleSessionNameConfigKey],
+		externalID:      config[externalIDConfigKey],
+		stsEndpoint:     config[stsEndpointConfigKey],
+	}
+	if role.roleArn == "" {
+		if role.roleSessionName != "" || role.externalID != "" {
+			return nil, errors.Errorf("%s and %s require %s", roleSessionNameConfigKey, externalIDConfigKey, roleArnConfigKey)
+		}
+		return nil, nil
+	}
+	if role.roleSessionName == "" {
+		role.roleSessionName = stsRoleSessionName
+	}
+	return role, nil
+}
+
+// oidcConfig holds the RRSA (RAM Roles for Service Accounts) settings used to
+// assume a RAM role with the OIDC token projected into the pod
+type oidcConfig struct {
+	roleArn         string
+	oidcProviderArn string
+	oidcTokenFile   string
+	stsEndpoint     string
+}
+
+// getOIDCConfig returns the RRSA settings from config, falling back to the
+// environment variables injected by the ACK RRSA webhook. It returns nil if
+// RRSA is not configured.
+func getOIDCConfig(config map[string]string, env credentialsEnv) (*oidcConfig, error) {
+	oidc := &oidcConfig{
+		roleArn:         config[oidcRoleArnConfigKey],
+		oidcProviderArn: config[oidcProviderArnConfigKey],
+		oidcTokenFile:   config[oidcTokenFileConfigKey],
+		stsEndpoint:     config[stsEndpointConfigKey],
+	}
+	if oidc.roleArn == "" {
+		oidc.roleArn = env.Getenv("ALIBABA_CLOUD_ROLE_ARN")
+	}
+	if oidc.oidcProviderArn == "" {
+		oidc.oidcProviderArn = env.Getenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN")
+	}
+	if oidc.oidcTokenFile == "" {
+		oidc.oidcTokenFile = env.Getenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE")
+	}
+
+	if oidc.roleArn == "" && oidc.oidcProviderArn == "" && oidc.oidcTokenFile == "" {
+		return nil, nil
+	}
+	if oidc.roleArn == "" || oidc.oidcProviderArn == "" || oidc.oidcTokenFile == "" {
+		return nil, errors.Errorf("RRSA requires a role ARN, an OIDC provider ARN and an OIDC token file, set %s, %s and %s "+
+			"or ALIBABA_CLOUD_ROLE_ARN, ALIBABA_CLOUD_OIDC_PROVIDER_ARN and ALIBABA_CLOUD_OIDC_TOKEN_FILE",
+			oidcRoleArnConfigKey, oidcProviderArnConfigKey, oidcTokenFileConfigKey)
+	}
+	return oidc, nil
+}
+
+// stsClient calls the STS OpenAPI. The endpoint may carry an http:// or https://
+// scheme, https is used when it has none.
+type stsClient struct {
+	client   *openapi.Client
+	protocol string // HTTP or HTTPS
+}
+
+func newStsClient(endpoint string, credential credentials.Credential) (*stsClient, error) {
+	if endpoint == "" {
+		endpoint = stsDefaultEndpoint
+	}
+	protocol := "https"
+	if scheme, host, ok := strings.Cut(endpoint, "://"); ok {
+		protocol, endpoint = strings.ToLower(scheme), host
+	}
+
+	client, err := openapi.NewClient(&openapi.Config{
+		Endpoint:   tea.String(endpoint),
+		Protocol:   tea.String(protocol),
+		Credential: credential,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create STS client for endpoint %s", endpoint)
+	}
+	return &stsClient{client: client, protocol: strings.ToUpper(protocol)}, nil
+}
+
+// stsCredentialsResponse is the body of the STS AssumeRole* responses
+type stsCredentialsResponse struct {
+	Credentials *struct {
+		AccessKeyId     string
+		AccessKeySecret string
+		SecurityToken   string
+		Expiration      string
+	}
+}
+
+// call calls an STS AssumeRole* action and returns the credentials of the session
+func (c *stsClient) call(ctx context.Context, action, authType string, form map[string]interface{}) (*ossCredentials, error) {
+	params := &openapi.Params{
+		Action:      tea.String(action),
+		Version:     tea.String(stsAPIVersion),
+		Protocol:    tea.String(c.protocol),
+		Pathname:    tea.String("/"),
+		Method:      tea.String("POST"),
+		AuthType:    tea.String(authType),
+		Style:       tea.String("RPC"),
+		ReqBodyType: tea.String("formData"),
+		BodyType:    tea.String("json"),
+	}
+	result, err := c.client.CallApiWithCtx(ctx, params, &openapi.OpenApiRequest{Body: form}, &dara.RuntimeOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(result["body"])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s response", action)
+	}
+	var response stsCredentialsResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s response", action)
+	}
+	if response.Credentials == nil || response.Credentials.AccessKeyId == "" {
+		return nil, errors.Errorf("%s response has no credentials", action)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, response.Credentials.Expiration)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid expiration in %s response", action)
+	}
+	return &ossCredentials{
+		accessKeyID:     response.Credentials.AccessKeyId,
+		accessKeySecret: response.Credentials.AccessKeySecret,
+		stsToken:        response.Credentials.SecurityToken,
+		expiration:      expiration,
+	}, nil
+}
+
+// assumeRoleWithOIDC returns the STS credentials of the RRSA role. The OIDC token
+// file is read on every call, so that the token rotated by the kubelet is used.
+func assumeRoleWithOIDC(ctx context.Context, oidc *oidcConfig) (*ossCredentials, error) {
+	token, err := os.ReadFile(oidc.oidcTokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read OIDC token file %s", oidc.oidcTokenFile)
+	}
+
+	client, err := newStsClient(oidc.stsEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := client.call(ctx, "AssumeRoleWithOIDC", "Anonymous", map[string]interface{}{
+		"RoleArn":         oidc.roleArn,
+		"OIDCProviderArn": oidc.oidcProviderArn,
+		"OIDCToken":       strings.TrimSpace(string(token)),
+		"RoleSessionName": stsRoleSessionName,
+		"DurationSeconds": strconv.Itoa(int(stsSessionDuration.Seconds())),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to assume role %s with OIDC", oidc.roleArn)
+	}
+	cred.oidc = oidc
+	return cred, nil
+}
+
+// assumeRole returns the STS credentials of the role, assumed with the current
+// credentials of base
+func assumeRole(ctx context.Context, base *credentialsProvider, role *roleConfig) (*ossCredentials, error) {
+	client, err := newStsClient(role.stsEndpoint, &openapiCredential{provider: base})
+	if err != nil {
+		return nil, err
+	}
+
+	form := map[string]interface{}{
+		"RoleArn":         role.roleArn,
+		"RoleSessionName": role.roleSessionName,
+		"DurationSeconds": strconv.Itoa(int(stsSessionDuration.Seconds())),
+	}
+	if role.externalID != "" {
+		form["ExternalId"] = role.externalID
+	}
+	cred, err := client.call(ctx, "AssumeRole", "AK", form)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to assume role %s", role.roleArn)
+	}
+	return cred, nil
+}
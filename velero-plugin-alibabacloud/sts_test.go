@@ -0,0 +1,409 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSTSServer is a local stand-in for the STS OpenAPI, recording the requests it serves
+type fakeSTSServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []url.Values
+	actions  []string
+	headers  []http.Header
+	fail     bool
+}
+
+func newFakeSTSServer(t *testing.T) *fakeSTSServer {
+	s := &fakeSTSServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeSTSServer) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.PostForm)
+	s.actions = append(s.actions, r.Header.Get("x-acs-action"))
+	s.headers = append(s.headers, r.Header.Clone())
+	n, fail := len(s.requests), s.fail
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if fail {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"Code":"InvalidParameter.OIDCToken","Message":"the OIDC token is expired","RequestId":"req"}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"RequestId": "req",
+		"Credentials": map[string]string{
+			"AccessKeyId":     fmt.Sprintf("STS.ak-%d", n),
+			"AccessKeySecret": "sts-sk",
+			"SecurityToken":   fmt.Sprintf("sts-token-%d", n),
+			"Expiration":      "2030-01-02T03:04:05Z",
+		},
+	})
+}
+
+// failRequests makes the server answer every following request with an error
+func (s *fakeSTSServer) failRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = true
+}
+
+func (s *fakeSTSServer) lastRequest() (string, url.Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.actions[len(s.actions)-1], s.requests[len(s.requests)-1]
+}
+
+func (s *fakeSTSServer) lastHeader() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers[len(s.headers)-1]
+}
+
+func writeOIDCToken(t *testing.T, path, token string) {
+	require.NoError(t, os.WriteFile(path, []byte(token+"\n"), 0600))
+}
+
+func TestGetOIDCConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		env           map[string]string
+		expected      *oidcConfig
+		expectedError string
+	}{
+		{
+			name:     "not configured",
+			expected: nil,
+		},
+		{
+			name: "from config",
+			config: map[string]string{
+				oidcRoleArnConfigKey:     "acs:ram::1:role/velero",
+				oidcProviderArnConfigKey: "acs:ram::1:oidc-provider/ack",
+				oidcTokenFileConfigKey:   "/var/run/token",
+				stsEndpointConfigKey:     "sts-vpc.cn-hangzhou.aliyuncs.com",
+			},
+			expected: &oidcConfig{
+				roleArn:         "acs:ram::1:role/velero",
+				oidcProviderArn: "acs:ram::1:oidc-provider/ack",
+				oidcTokenFile:   "/var/run/token",
+				stsEndpoint:     "sts-vpc.cn-hangzhou.aliyuncs.com",
+			},
+		},
+		{
+			name: "from environment injected by the RRSA webhook",
+			env: map[string]string{
+				"ALIBABA_CLOUD_ROLE_ARN":          "acs:ram::1:role/velero",
+				"ALIBABA_CLOUD_OIDC_PROVIDER_ARN": "acs:ram::1:oidc-provider/ack",
+				"ALIBABA_CLOUD_OIDC_TOKEN_FILE":   "/var/run/token",
+			},
+			expected: &oidcConfig{
+				roleArn:         "acs:ram::1:role/velero",
+				oidcProviderArn: "acs:ram::1:oidc-provider/ack",
+				oidcTokenFile:   "/var/run/token",
+			},
+		},
+		{
+			name:   "config takes precedence over environment",
+			config: map[string]string{oidcRoleArnConfigKey: "acs:ram::2:role/vault"},
+			env: map[string]string{
+				"ALIBABA_CLOUD_ROLE_ARN":          "acs:ram::1:role/velero",
+				"ALIBABA_CLOUD_OIDC_PROVIDER_ARN": "acs:ram::1:oidc-provider/ack",
+				"ALIBABA_CLOUD_OIDC_TOKEN_FILE":   "/var/run/token",
+			},
+			expected: &oidcConfig{
+				roleArn:         "acs:ram::2:role/vault",
+				oidcProviderArn: "acs:ram::1:oidc-provider/ack",
+				oidcTokenFile:   "/var/run/token",
+			},
+		},
+		{
+			name:          "incomplete",
+			config:        map[string]string{oidcRoleArnConfigKey: "acs:ram::1:role/velero"},
+			expectedError: "RRSA requires a role ARN, an OIDC provider ARN and an OIDC token file",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"ALIBABA_CLOUD_ROLE_ARN", "ALIBABA_CLOUD_OIDC_PROVIDER_ARN", "ALIBABA_CLOUD_OIDC_TOKEN_FILE"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			oidc, err := getOIDCConfig(tc.config, credentialsEnv{})
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, oidc)
+		})
+	}
+}
+
+func TestNewStsClient(t *testing.T) {
+	tests := []struct {
+		endpoint         string
+		expectedEndpoint string
+		expectedProtocol string
+	}{
+		{endpoint: "", expectedEndpoint: stsDefaultEndpoint, expectedProtocol: "HTTPS"},
+		{endpoint: "sts-vpc.cn-hangzhou.aliyuncs.com", expectedEndpoint: "sts-vpc.cn-hangzhou.aliyuncs.com", expectedProtocol: "HTTPS"},
+		{endpoint: "https://sts.aliyuncs.com", expectedEndpoint: "sts.aliyuncs.com", expectedProtocol: "HTTPS"},
+		{endpoint: "http://127.0.0.1:8080", expectedEndpoint: "127.0.0.1:8080", expectedProtocol: "HTTP"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.endpoint, func(t *testing.T) {
+			client, err := newStsClient(tc.endpoint, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedEndpoint, tea.StringValue(client.client.Endpoint))
+			assert.Equal(t, tc.expectedProtocol, client.protocol)
+		})
+	}
+}
+
+func TestAssumeRoleWithOIDC(t *testing.T) {
+	server := newFakeSTSServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	oidc := &oidcConfig{
+		roleArn:         "acs:ram::1:role/velero",
+		oidcProviderArn: "acs:ram::1:oidc-provider/ack",
+		oidcTokenFile:   tokenFile,
+		stsEndpoint:     server.URL,
+	}
+
+	writeOIDCToken(t, tokenFile, "token-1")
+	cred, err := assumeRoleWithOIDC(context.Background(), oidc)
+	require.NoError(t, err)
+	assert.Equal(t, "STS.ak-1", cred.accessKeyID)
+	assert.Equal(t, "sts-sk", cred.accessKeySecret)
+	assert.Equal(t, "sts-token-1", cred.stsToken)
+	assert.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), cred.expiration)
+	assert.Same(t, oidc, cred.oidc)
+
+	action, form := server.lastRequest()
+	assert.Equal(t, "AssumeRoleWithOIDC", action)
+	assert.Equal(t, "acs:ram::1:role/velero", form.Get("RoleArn"))
+	assert.Equal(t, "acs:ram::1:oidc-provider/ack", form.Get("OIDCProviderArn"))
+	assert.Equal(t, "token-1", form.Get("OIDCToken"))
+	assert.Equal(t, stsRoleSessionName, form.Get("RoleSessionName"))
+	assert.Equal(t, "3600", form.Get("DurationSeconds"))
+
+	// The token rotated by the kubelet is picked up on the next call
+	writeOIDCToken(t, tokenFile, "token-2")
+	cred, err = assumeRoleWithOIDC(context.Background(), oidc)
+	require.NoError(t, err)
+	assert.Equal(t, "sts-token-2", cred.stsToken)
+	_, form = server.lastRequest()
+	assert.Equal(t, "token-2", form.Get("OIDCToken"))
+
+	server.failRequests()
+	_, err = assumeRoleWithOIDC(context.Background(), oidc)
+	assert.ErrorContains(t, err, "failed to assume role acs:ram::1:role/velero with OIDC")
+	assert.ErrorContains(t, err, "the OIDC token is expired")
+
+	require.NoError(t, os.Remove(tokenFile))
+	_, err = assumeRoleWithOIDC(context.Background(), oidc)
+	assert.ErrorContains(t, err, "failed to read OIDC token file")
+}
+
+func TestNewCredentialsProviderFromConfig_RRSA(t *testing.T) {
+	server := newFakeSTSServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeOIDCToken(t, tokenFile, "token-1")
+
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "")
+	t.Setenv("ALIBABA_CLOUD_RAM_ROLE", "")
+	t.Setenv("ALIBABA_CLOUD_ROLE_ARN", "acs:ram::1:role/velero")
+	t.Setenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN", "acs:ram::1:oidc-provider/ack")
+	t.Setenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE", tokenFile)
+
+	provider, err := newCredentialsProviderFromConfig(newTestLogger(), map[string]string{
+		notOnECSConfigKey:    "true",
+		stsEndpointConfigKey: server.URL,
+	})
+	require.NoError(t, err)
+	cred, err := provider.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "sts-token-1", cred.stsToken)
+
+	// Credentials about to expire are refreshed with the rotated token
+	writeOIDCToken(t, tokenFile, "token-2")
+	provider.mu.Lock()
+	provider.cred.expiration = time.Now()
+	provider.mu.Unlock()
+
+	cred, err = provider.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "sts-token-2", cred.stsToken)
+	_, form := server.lastRequest()
+	assert.Equal(t, "token-2", form.Get("OIDCToken"))
+}
+
+func TestGetRoleConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expected      *roleConfig
+		expectedError string
+	}{
+		{
+			name:     "not configured",
+			expected: nil,
+		},
+		{
+			name:   "default session name",
+			config: map[string]string{roleArnConfigKey: "acs:ram::2:role/vault"},
+			expected: &roleConfig{
+				roleArn:         "acs:ram::2:role/vault",
+				roleSessionName: stsRoleSessionName,
+			},
+		},
+		{
+			name: "all settings",
+			config: map[string]string{
+				roleArnConfigKey:         "acs:ram::2:role/vault",
+				roleSessionNameConfigKey: "cluster1",
+				externalIDConfigKey:      "abcd1234",
+				stsEndpointConfigKey:     "sts-vpc.cn-hangzhou.aliyuncs.com",
+			},
+			expected: &roleConfig{
+				roleArn:         "acs:ram::2:role/vault",
+				roleSessionName: "cluster1",
+				externalID:      "abcd1234",
+				stsEndpoint:     "sts-vpc.cn-hangzhou.aliyuncs.com",
+			},
+		},
+		{
+			name:          "external ID without role",
+			config:        map[string]string{externalIDConfigKey: "abcd1234"},
+			expectedError: "roleSessionName and externalId require roleArn",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			role, err := getRoleConfig(tc.config)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, role)
+		})
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	server := newFakeSTSServer(t)
+	role := &roleConfig{
+		roleArn:         "acs:ram::2:role/vault",
+		roleSessionName: "cluster1",
+		externalID:      "abcd1234",
+		stsEndpoint:     server.URL,
+	}
+
+	base := newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "base-ak", accessKeySecret: "base-sk"}, nil)
+	cred, err := assumeRole(context.Background(), base, role)
+	require.NoError(t, err)
+	assert.Equal(t, "STS.ak-1", cred.accessKeyID)
+	assert.Equal(t, "sts-token-1", cred.stsToken)
+	assert.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), cred.expiration)
+
+	action, form := server.lastRequest()
+	assert.Equal(t, "AssumeRole", action)
+	assert.Equal(t, "acs:ram::2:role/vault", form.Get("RoleArn"))
+	assert.Equal(t, "cluster1", form.Get("RoleSessionName"))
+	assert.Equal(t, "abcd1234", form.Get("ExternalId"))
+	assert.Equal(t, "3600", form.Get("DurationSeconds"))
+	assert.Contains(t, server.lastHeader().Get("Authorization"), "Credential=base-ak,")
+	assert.Empty(t, server.lastHeader().Get("x-acs-security-token"))
+
+	// Base STS credentials, such as those of an instance or RRSA role, are signed with their token
+	base = newCachedCredentialsProvider(newTestLogger(), &ossCredentials{accessKeyID: "STS.base", accessKeySecret: "base-sk", stsToken: "base-token"}, nil)
+	_, err = assumeRole(context.Background(), base, role)
+	require.NoError(t, err)
+	assert.Contains(t, server.lastHeader().Get("Authorization"), "Credential=STS.base,")
+	assert.Equal(t, "base-token", server.lastHeader().Get("x-acs-security-token"))
+
+	server.failRequests()
+	_, err = assumeRole(context.Background(), base, role)
+	assert.ErrorContains(t, err, "failed to assume role acs:ram::2:role/vault")
+}
+
+func TestNewCredentialsProviderFromConfig_AssumeRole(t *testing.T) {
+	server := newFakeSTSServer(t)
+
+	t.Setenv("ALIBABA_CLOUD_CREDENTIALS_FILE", "")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", "base-ak")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "base-sk")
+	t.Setenv("ALIBABA_CLOUD_ACCESS_STS_TOKEN", "")
+
+	provider, err := newCredentialsProviderFromConfig(newTestLogger(), map[string]string{
+		roleArnConfigKey:     "acs:ram::2:role/vault",
+		stsEndpointConfigKey: server.URL,
+	})
+	require.NoError(t, err)
+	cred, err := provider.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "sts-token-1", cred.stsToken)
+
+	// Assumed credentials about to expire are assumed again
+	provider.mu.Lock()
+	provider.cred.expiration = time.Now()
+	provider.mu.Unlock()
+
+	cred, err = provider.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "sts-token-2", cred.stsToken)
+	assert.Contains(t, server.lastHeader().Get("Authorization"), "Credential=base-ak,")
+
+	server.failRequests()
+	_, err = newCredentialsProviderFromConfig(newTestLogger(), map[string]string{
+		roleArnConfigKey:     "acs:ram::2:role/vault",
+		stsEndpointConfigKey: server.URL,
+	})
+	assert.ErrorContains(t, err, "failed to assume role acs:ram::2:role/vault")
+}
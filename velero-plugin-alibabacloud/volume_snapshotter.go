@@ -18,11 +18,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
+	"github.com/alibabacloud-go/tea/dara"
 	"github.com/alibabacloud-go/tea/tea"
-	alicloudErr "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -57,43 +59,138 @@ type ecsClientInterface interface {
 	DeleteSnapshot(request *ecs20140526.DeleteSnapshotRequest) (*ecs20140526.DeleteSnapshotResponse, error)
 	DescribeSnapshots(request *ecs20140526.DescribeSnapshotsRequest) (*ecs20140526.DescribeSnapshotsResponse, error)
 	DescribeDisks(request *ecs20140526.DescribeDisksRequest) (*ecs20140526.DescribeDisksResponse, error)
+	DeleteDisk(request *ecs20140526.DeleteDiskRequest) (*ecs20140526.DeleteDiskResponse, error)
 }
 
-// ecsClientWrapper wraps ecs20140526.Client to implement ecsClientInterface
+// ecsClientWrapper implements ecsClientInterface with ecs20140526.Client.
+// Every call is retried according to the retry policy. CreateDisk and
+// CreateSnapshot are idempotent only with a ClientToken, without one they are
+// retried only when ECS did not process the request. It is safe for concurrent
+// use.
 type ecsClientWrapper struct {
+	log   logrus.FieldLogger
+	retry *retryPolicy
+
+	// An ecs20140526.Client changes its own state on every call, so calls are
+	// sent one at a time, each bounded by the read timeout of its attempt
+	mu     sync.Mutex
 	client *ecs20140526.Client
 }
 
-func (w *ecsClientWrapper) CreateDisk(request *ecs20140526.CreateDiskRequest) (*ecs20140526.CreateDiskResponse, error) {
-	return w.client.CreateDisk(request)
+// newEcsClientWrapper returns a client for config, retrying its calls according
+// to policy
+func newEcsClientWrapper(config *openapi.Config, log logrus.FieldLogger, policy *retryPolicy) (*ecsClientWrapper, error) {
+	client, err := ecs20140526.NewClient(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create ECS client with region %s", tea.StringValue(config.RegionId))
+	}
+	return &ecsClientWrapper{log: log, retry: policy, client: client}, nil
+}
+
+// call calls fn with the ECS client once no other call uses it
+func (w *ecsClientWrapper) call(fn func(client *ecs20140526.Client) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return fn(w.client)
+}
+
+// attempt returns the runtime options of an attempt with the given read timeout.
+// Retries are done by the wrapper, not by the SDK. The SDK keeps an HTTP client
+// for every distinct timeout and applies the connect timeout in seconds, so both
+// are rounded up to whole seconds.
+func (w *ecsClientWrapper) attempt(readTimeout time.Duration) *dara.RuntimeOptions {
+	return &dara.RuntimeOptions{
+		ConnectTimeout: tea.Int(int(ceilSeconds(w.retry.connectTimeout))),
+		ReadTimeout:    tea.Int(int(ceilSeconds(readTimeout) * 1000)),
+		Autoretry:      tea.Bool(false),
+	}
+}
+
+// ceilSeconds returns d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+func (w *ecsClientWrapper) CreateDisk(request *ecs20140526.CreateDiskRequest) (response *ecs20140526.CreateDiskResponse, err error) {
+	err = w.retry.do(w.log, "CreateDisk", request.ClientToken != nil, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.CreateDiskWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
 }
 
-func (w *ecsClientWrapper) CreateSnapshot(request *ecs20140526.CreateSnapshotRequest) (*ecs20140526.CreateSnapshotResponse, error) {
-	return w.client.CreateSnapshot(request)
+func (w *ecsClientWrapper) CreateSnapshot(request *ecs20140526.CreateSnapshotRequest) (response *ecs20140526.CreateSnapshotResponse, err error) {
+	err = w.retry.do(w.log, "CreateSnapshot", request.ClientToken != nil, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.CreateSnapshotWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
 }
 
-func (w *ecsClientWrapper) DeleteSnapshot(request *ecs20140526.DeleteSnapshotRequest) (*ecs20140526.DeleteSnapshotResponse, error) {
-	return w.client.DeleteSnapshot(request)
+func (w *ecsClientWrapper) DeleteSnapshot(request *ecs20140526.DeleteSnapshotRequest) (response *ecs20140526.DeleteSnapshotResponse, err error) {
+	err = w.retry.do(w.log, "DeleteSnapshot", true, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.DeleteSnapshotWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
 }
 
-func (w *ecsClientWrapper) DescribeSnapshots(request *ecs20140526.DescribeSnapshotsRequest) (*ecs20140526.DescribeSnapshotsResponse, error) {
-	return w.client.DescribeSnapshots(request)
+func (w *ecsClientWrapper) DescribeSnapshots(request *ecs20140526.DescribeSnapshotsRequest) (response *ecs20140526.DescribeSnapshotsResponse, err error) {
+	err = w.retry.do(w.log, "DescribeSnapshots", true, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.DescribeSnapshotsWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
 }
 
-func (w *ecsClientWrapper) DescribeDisks(request *ecs20140526.DescribeDisksRequest) (*ecs20140526.DescribeDisksResponse, error) {
-	return w.client.DescribeDisks(request)
+func (w *ecsClientWrapper) DescribeDisks(request *ecs20140526.DescribeDisksRequest) (response *ecs20140526.DescribeDisksResponse, err error) {
+	err = w.retry.do(w.log, "DescribeDisks", true, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.DescribeDisksWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
+}
+
+func (w *ecsClientWrapper) DeleteDisk(request *ecs20140526.DeleteDiskRequest) (response *ecs20140526.DeleteDiskResponse, err error) {
+	err = w.retry.do(w.log, "DeleteDisk", true, func(readTimeout time.Duration) error {
+		return w.call(func(client *ecs20140526.Client) error {
+			response, err = client.DeleteDiskWithOptions(request, w.attempt(readTimeout))
+			return err
+		})
+	})
+	return response, err
 }
 
 // VolumeSnapshotter struct
+// Its methods may be called concurrently once Init returns, the ECS client is
+// created by Init and never replaced.
 type VolumeSnapshotter struct {
 	log            logrus.FieldLogger
 	client         ecsClientInterface
 	region         string
 	zone           string
-	ramRole        string
-	rawClient      *ecs20140526.Client  // Keep raw client for updateEcsClient
+	credentials    *credentialsProvider // Cached credentials used by the ECS client
 	kubeClient     kubernetes.Interface // Kubernetes client for ConfigMap queries (optional)
 	supportedZones map[string]bool      // Set of supported zones from ack-cluster-profile ConfigMap
+
+	snapshotReadyTimeout time.Duration // How long to wait for a snapshot to be accomplished
+	snapshotPollInterval time.Duration // How often the snapshot status is checked
+	waitForSnapshotReady bool          // Whether CreateSnapshot waits for the snapshot to be accomplished
+	diskReadyTimeout     time.Duration // How long to wait for a restored disk to be available
+	diskPollInterval     time.Duration // How often the disk status is checked
+
+	instantAccess              bool // Whether snapshots are created with instant access
+	instantAccessRetentionDays int  // How long instant access is kept, 0 for the ECS default
 }
 
 // newVolumeSnapshotter init a VolumeSnapshotter
@@ -118,19 +215,40 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 	zoneID := getEcsZoneID(config)
 	b.zone = zoneID
 
-	cred, err := getCredentials(config)
+	policy, err := getRetryPolicy(config)
+	if err != nil {
+		return err
+	}
+
+	b.snapshotReadyTimeout, err = getConfigDuration(config, snapshotReadyTimeoutConfigKey, defaultSnapshotReadyTimeout)
+	if err != nil {
+		return err
+	}
+	b.snapshotPollInterval = defaultSnapshotPollInterval
+	b.waitForSnapshotReady = strings.EqualFold(config[waitForSnapshotReadyConfigKey], "true")
+
+	b.diskReadyTimeout, err = getConfigDuration(config, diskReadyTimeoutConfigKey, defaultDiskReadyTimeout)
+	if err != nil {
+		return err
+	}
+	b.diskPollInterval = defaultDiskPollInterval
+
+	if err := b.initInstantAccess(config); err != nil {
+		return err
+	}
+
+	credentials, err := newCredentialsProviderFromConfig(b.log, config)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get credentials")
 	}
 
-	b.ramRole = cred.ramRole
-	rawClient, err := b.getEcsClient(cred)
+	b.credentials = credentials
+	client, err := newEcsClientWrapper(b.getEcsConfig(), b.log, policy)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create ECS client")
 	}
 
-	b.rawClient = rawClient
-	b.client = &ecsClientWrapper{client: rawClient}
+	b.client = client
 	b.supportedZones = make(map[string]bool)
 
 	// Try to initialize Kubernetes client and load supported zones from ConfigMap (best-effort)
@@ -154,17 +272,18 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 // availability zone, initialized from the provided snapshot,
 // and with the specified type and IOPS (if using provisioned IOPS).
 func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (volumeID string, err error) {
-	// Update ECS client if needed (for STS token refresh)
-	if err := b.updateEcsClient(); err != nil {
-		return "", errors.Wrapf(err, "failed to update ECS client for creating volume from snapshot %s", snapshotID)
-	}
-
 	// Describe the snapshot so we can apply its tags to the volume
 	snapInfo, err := b.describeSnapshot(snapshotID)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to describe snapshot %s", snapshotID)
 	}
 
+	// A disk can only be created from an accomplished or instant access snapshot
+	snapInfo, err = b.waitForSnapshot(snapInfo, true)
+	if err != nil {
+		return "", err
+	}
+
 	tags := b.getTagsForCluster(snapInfo.Tags.Tag)
 
 	// Use volumeAZ from parameter if provided, otherwise determine from snapshot tags or metadata
@@ -197,10 +316,18 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		b.log.Warnf("Converting IOPS: %d to Performance Level: %s, Max supported random read/write IOPS: %d. Note: Only ESSD cloud disks support setting Performance Level.",
 			*iops, performanceLevel, maxIOPS)
 	}
+
 	if len(tags) > 0 {
 		req.Tag = tags
 	}
 
+	// A restore has no tags of its own, so the disks of two restores of the same
+	// backup cannot be told apart, and an earlier disk may already hold data
+	// written after the restore. The token only makes the retries of this call
+	// idempotent.
+	key := idempotencyKey(snapshotID, []string{volumeAZ, volumeType, tea.StringValue(req.PerformanceLevel)}, diskTagsMap(tags))
+	req.ClientToken = tea.String(clientToken(key, time.Now()))
+
 	res, err := b.client.CreateDisk(req)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to create disk from snapshot %s", snapshotID)
@@ -209,8 +336,18 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 	if res.Body == nil || res.Body.DiskId == nil {
 		return "", errors.New("create disk response missing disk ID")
 	}
+	volumeID = tea.StringValue(res.Body.DiskId)
 
-	return tea.StringValue(res.Body.DiskId), nil
+	// The disk is attached right after the restore, which fails while it is still being created
+	if err := b.waitForDisk(volumeID, volumeAZ); err != nil {
+		// Velero does not record the ID of a failed volume, so it would be left behind
+		if deleteErr := b.deleteDisk(volumeID, volumeAZ); deleteErr != nil {
+			return "", errors.Errorf("%v, and disk %s could not be deleted, delete it manually: %v", err, volumeID, deleteErr)
+		}
+		return "", err
+	}
+
+	return volumeID, nil
 }
 
 // GetVolumeID returns the cloud provider specific identifier for the PersistentVolume.
@@ -251,11 +388,6 @@ func (b *VolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured, vol
 // GetVolumeInfo returns the type and IOPS (if using provisioned IOPS) for
 // the specified volume in the given availability zone.
 func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	// Update ECS client if needed (for STS token refresh)
-	if err := b.updateEcsClient(); err != nil {
-		return "", nil, errors.Wrapf(err, "failed to update ECS client for getting info of volume %s", volumeID)
-	}
-
 	volumeInfo, err := b.describeVolume(volumeID, volumeAZ)
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "failed to describe volume %s", volumeID)
@@ -272,11 +404,6 @@ func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *i
 // CreateSnapshot creates a snapshot of the specified volume, and applies the provided
 // set of tags to the snapshot.
 func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (snapshotID string, err error) {
-	// Update ECS client if needed (for STS token refresh)
-	if err := b.updateEcsClient(); err != nil {
-		return "", errors.Wrapf(err, "failed to update ECS client for creating snapshot of volume %s", volumeID)
-	}
-
 	// Describe the volume so we can copy its tags to the snapshot
 	volumeInfo, err := b.describeVolume(volumeID, volumeAZ)
 	if err != nil {
@@ -286,6 +413,12 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 	req := &ecs20140526.CreateSnapshotRequest{
 		DiskId: tea.String(volumeID),
 	}
+	if b.instantAccess {
+		req.InstantAccess = tea.Bool(true)
+		if b.instantAccessRetentionDays > 0 {
+			req.InstantAccessRetentionDays = tea.Int32(int32(b.instantAccessRetentionDays))
+		}
+	}
 
 	// Get volume zone ID for tagging
 	volumeZoneID := ""
@@ -294,29 +427,55 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 	}
 
 	newTags := b.getTagsWithVolumeZone(tags, volumeInfo.Tags.Tag, volumeZoneID)
-	if len(newTags) > 0 {
-		req.Tag = newTags
-	}
 
-	res, err := b.client.CreateSnapshot(req)
+	// The Velero tags name the backup and the persistent volume, so an earlier
+	// request for the same snapshot is found by its key
+	key := idempotencyKey(volumeID, nil, tags)
+	newTags = append(newTags, &ecs20140526.CreateSnapshotRequestTag{
+		Key:   tea.String(idempotencyKeyTagKey),
+		Value: tea.String(key),
+	})
+	req.Tag = newTags
+	req.ClientToken = tea.String(clientToken(key, time.Now().Truncate(clientTokenWindow)))
+
+	existing, err := b.findSnapshot(volumeID, key)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to create snapshot for volume %s", volumeID)
+		return "", err
+	}
+	if existing != nil {
+		snapshotID = tea.StringValue(existing.SnapshotId)
+		b.log.Infof("reusing snapshot %s of volume %s created by an earlier request", snapshotID, volumeID)
+	} else {
+		res, err := b.client.CreateSnapshot(req)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to create snapshot for volume %s", volumeID)
+		}
+
+		if res.Body == nil || res.Body.SnapshotId == nil {
+			return "", errors.New("create snapshot response missing snapshot ID")
+		}
+		snapshotID = tea.StringValue(res.Body.SnapshotId)
 	}
 
-	if res.Body == nil || res.Body.SnapshotId == nil {
-		return "", errors.New("create snapshot response missing snapshot ID")
+	if b.waitForSnapshotReady {
+		snapshot, err := b.describeSnapshot(snapshotID)
+		if err == nil {
+			_, err = b.waitForSnapshot(snapshot, false)
+		}
+		if err != nil {
+			// Velero does not record the ID of a failed snapshot, so it would be left behind
+			if deleteErr := b.DeleteSnapshot(snapshotID); deleteErr != nil {
+				b.log.Warnf("failed to delete snapshot %s: %v", snapshotID, deleteErr)
+			}
+			return "", errors.Wrapf(err, "failed to wait for snapshot %s of volume %s", snapshotID, volumeID)
+		}
 	}
 
-	return tea.StringValue(res.Body.SnapshotId), nil
+	return snapshotID, nil
 }
 
 // DeleteSnapshot deletes the specified volume snapshot.
 func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
-	// Update ECS client if needed (for STS token refresh)
-	if err := b.updateEcsClient(); err != nil {
-		return errors.Wrapf(err, "failed to update ECS client for deleting snapshot %s", snapshotID)
-	}
-
 	req := &ecs20140526.DeleteSnapshotRequest{
 		SnapshotId: tea.String(snapshotID),
 	}
@@ -326,9 +485,9 @@ func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
 		// If it's a NotFound error, we don't need to return an error
 		// since the snapshot is not there (similar to AWS plugin behavior)
 		// Alibaba Cloud ECS returns error code "InvalidSnapshotId.NotFound" for non-existent snapshots
-		var aliErr *alicloudErr.ServerError
-		if errors.As(err, &aliErr) && aliErr.ErrorCode() == "InvalidSnapshotId.NotFound" {
-			b.log.Warnf("snapshot %s is not found, skip deleting")
+		_, code, _ := getErrorStatus(err)
+		if code == "InvalidSnapshotId.NotFound" {
+			b.log.Warnf("snapshot %s is not found, skip deleting", snapshotID)
 			return nil
 		}
 		return errors.Wrapf(err, "failed to delete snapshot %s", snapshotID)
@@ -341,55 +500,13 @@ func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
 // VolumeSnapshotter internal utility functions (not part of Velero plugin interface)
 // ============================================================================
 
-// updateEcsClient updates the ECS client with fresh credentials if using RAM role
-func (b *VolumeSnapshotter) updateEcsClient() error {
-	// Only update if we have RAM role
-	if len(b.ramRole) == 0 {
-		return nil
+// getEcsConfig returns the ECS client config using the cached credentials of the VolumeSnapshotter
+// The clients pick up refreshed credentials on every request
+func (b *VolumeSnapshotter) getEcsConfig() *openapi.Config {
+	return &openapi.Config{
+		Credential: &openapiCredential{provider: b.credentials},
+		RegionId:   tea.String(b.region),
 	}
-
-	// Get new STS credentials
-	accessKeyID, accessKeySecret, stsToken, err := getSTSAK(b.ramRole)
-	if err != nil {
-		return errors.Wrapf(err, "failed to get STS token for RAM role %s", b.ramRole)
-	}
-
-	cred := &ossCredentials{
-		accessKeyID:     accessKeyID,
-		accessKeySecret: accessKeySecret,
-		stsToken:        stsToken,
-	}
-
-	// Create new ECS client with updated credentials
-	rawClient, err := b.getEcsClient(cred)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create new ECS client with updated credentials")
-	}
-
-	b.rawClient = rawClient
-	b.client = &ecsClientWrapper{client: rawClient}
-	return nil
-}
-
-// getEcsClient creates a new ECS client using the provided credentials
-// This function only handles ECS client initialization, credentials should be obtained separately
-func (b *VolumeSnapshotter) getEcsClient(cred *ossCredentials) (*ecs20140526.Client, error) {
-	config := &openapi.Config{
-		AccessKeyId:     tea.String(cred.accessKeyID),
-		AccessKeySecret: tea.String(cred.accessKeySecret),
-		RegionId:        tea.String(b.region),
-	}
-
-	if len(cred.stsToken) > 0 {
-		config.SecurityToken = tea.String(cred.stsToken)
-	}
-
-	client, err := ecs20140526.NewClient(config)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create ECS client with region %s", b.region)
-	}
-
-	return client, nil
 }
 
 // describeSnapshot describes a snapshot by ID
@@ -464,6 +581,9 @@ func (b *VolumeSnapshotter) getTagsForCluster(snapshotTags []*ecs20140526.Descri
 			continue
 		}
 		tagKey := tea.StringValue(tag.TagKey)
+		if tagKey == idempotencyKeyTagKey {
+			continue
+		}
 		if haveACKClusterNameEnvVar && (strings.HasPrefix(tagKey, "kubernetes.io/cluster/") || tagKey == "KubernetesCluster") {
 			// if the ACK_CLUSTER_NAME variable is found we want current cluster
 			// to overwrite the old ownership on volumes
@@ -499,7 +619,7 @@ func (b *VolumeSnapshotter) getTags(veleroTags map[string]string, volumeTags []*
 		tagKey := tea.StringValue(tag.TagKey)
 		// we want current Velero-assigned tags to overwrite any older versions
 		// of them that may exist due to prior snapshots/restores
-		if _, found := veleroTags[tagKey]; found {
+		if _, found := veleroTags[tagKey]; found || tagKey == idempotencyKeyTagKey {
 			continue
 		}
 
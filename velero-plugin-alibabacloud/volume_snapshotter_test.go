@@ -14,12 +14,22 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	ecs20140526 "github.com/alibabacloud-go/ecs-20140526/v4/client"
 	"github.com/alibabacloud-go/tea/tea"
-	alicloudErr "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -516,6 +526,14 @@ func (m *mockECSClient) DescribeDisks(request *ecs20140526.DescribeDisksRequest)
 	return args.Get(0).(*ecs20140526.DescribeDisksResponse), args.Error(1)
 }
 
+func (m *mockECSClient) DeleteDisk(request *ecs20140526.DeleteDiskRequest) (*ecs20140526.DeleteDiskResponse, error) {
+	args := m.Called(request)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ecs20140526.DeleteDiskResponse), args.Error(1)
+}
+
 func TestCreateSnapshot(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -551,16 +569,57 @@ func TestCreateSnapshot(t *testing.T) {
 					},
 				}
 				m.On("DescribeDisks", mock.Anything).Return(diskResponse, nil)
+				m.On("DescribeSnapshots", mock.Anything).Return(&ecs20140526.DescribeSnapshotsResponse{}, nil)
 
 				snapshotResponse := &ecs20140526.CreateSnapshotResponse{
 					Body: &ecs20140526.CreateSnapshotResponseBody{
 						SnapshotId: tea.String("s-123456"),
 					},
 				}
-				m.On("CreateSnapshot", mock.Anything).Return(snapshotResponse, nil)
+				m.On("CreateSnapshot", mock.MatchedBy(func(req *ecs20140526.CreateSnapshotRequest) bool {
+					key := idempotencyKey("d-123456", nil, map[string]string{"velero-backup": "backup-123"})
+					return strings.HasPrefix(tea.StringValue(req.ClientToken), key+"-") && hasSnapshotTag(req.Tag, idempotencyKeyTagKey, key)
+				})).Return(snapshotResponse, nil)
 			},
 			expectedID: "s-123456",
 		},
+		{
+			name:     "success - reuse snapshot created by an earlier request",
+			volumeID: "d-123456",
+			volumeAZ: "cn-hangzhou-h",
+			tags: map[string]string{
+				"velero-backup": "backup-123",
+			},
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-123456", diskStatusInUse), nil)
+				m.On("DescribeSnapshots", mock.MatchedBy(func(req *ecs20140526.DescribeSnapshotsRequest) bool {
+					return tea.StringValue(req.DiskId) == "d-123456" && len(req.Tag) == 1 &&
+						tea.StringValue(req.Tag[0].Key) == idempotencyKeyTagKey &&
+						tea.StringValue(req.Tag[0].Value) == idempotencyKey("d-123456", nil, map[string]string{"velero-backup": "backup-123"})
+				})).Return(&ecs20140526.DescribeSnapshotsResponse{
+					Body: &ecs20140526.DescribeSnapshotsResponseBody{
+						Snapshots: &ecs20140526.DescribeSnapshotsResponseBodySnapshots{
+							Snapshot: []*ecs20140526.DescribeSnapshotsResponseBodySnapshotsSnapshot{
+								snapshotWithStatus("s-failed", snapshotStatusFailed, "10%"),
+								snapshotWithStatus("s-123456", "progressing", "50%"),
+							},
+						},
+					},
+				}, nil)
+			},
+			expectedID: "s-123456",
+		},
+		{
+			name:     "error - look up of existing snapshots fails",
+			volumeID: "d-123456",
+			volumeAZ: "cn-hangzhou-h",
+			tags:     map[string]string{},
+			mockSetup: func(m *mockECSClient) {
+				m.On("DescribeDisks", mock.Anything).Return(describeDisksResponse("d-123456", diskStatusInUse), nil)
+				m.On("DescribeSnapshots", mock.Anything).Return(nil, errors.New("throttled"))
+			},
+			expectedError: "failed to look up existing snapshots of volume d-123456",
+		},
 		{
 			name:     "error - describe disk fails",
 			volumeID: "d-123456",
@@ -592,6 +651,7 @@ func TestCreateSnapshot(t *testing.T) {
 					},
 				}
 				m.On("DescribeDisks", mock.Anything).Return(diskResponse, nil)
+				m.On("DescribeSnapshots", mock.Anything).Return(&ecs20140526.DescribeSnapshotsResponse{}, nil)
 				m.On("CreateSnapshot", mock.Anything).Return(nil, errors.New("create snapshot failed"))
 			},
 			expectedError: "failed to create snapshot for volume d-123456",
@@ -617,6 +677,7 @@ func TestCreateSnapshot(t *testing.T) {
 					},
 				}
 				m.On("DescribeDisks", mock.Anything).Return(diskResponse, nil)
+				m.On("DescribeSnapshots", mock.Anything).Return(&ecs20140526.DescribeSnapshotsResponse{}, nil)
 
 				snapshotResponse := &ecs20140526.CreateSnapshotResponse{
 					Body: &ecs20140526.CreateSnapshotResponseBody{
@@ -678,7 +739,7 @@ func TestDeleteSnapshot_NotFound(t *testing.T) {
 	client := new(mockECSClient)
 	defer client.AssertExpectations(t)
 
-	serverErr := alicloudErr.NewServerError(404, `{"Code":"InvalidSnapshotId.NotFound","Message":"The specified snapshot does not exist."}`, "")
+	serverErr := tea.NewSDKError(map[string]interface{}{"code": "InvalidSnapshotId.NotFound", "statusCode": 404})
 	client.On("DeleteSnapshot", mock.Anything).Return(nil, serverErr)
 
 	b := &VolumeSnapshotter{
@@ -1330,3 +1391,191 @@ func TestDetermineVolumeAZ(t *testing.T) {
 		})
 	}
 }
+
+// fakeECSServer is a minimal in-memory ECS endpoint serving the disk and
+// snapshot actions used by the VolumeSnapshotter
+type fakeECSServer struct {
+	*httptest.Server
+
+	mu              sync.Mutex
+	snapshots       map[string]fakeResource
+	disks           map[string]fakeResource
+	tokens          map[string]string // Snapshot and disk IDs by ClientToken
+	created         int
+	createdDisks    int
+	failCreateDisks int // Number of CreateDisk requests failing after the disk was created
+}
+
+// fakeResource is a snapshot or disk of fakeECSServer
+type fakeResource struct {
+	source string // Disk of a snapshot, or snapshot of a disk
+	key    string // Value of the idempotency key tag
+}
+
+func newFakeECSServer(t *testing.T) *fakeECSServer {
+	f := &fakeECSServer{snapshots: map[string]fakeResource{}, disks: map[string]fakeResource{}, tokens: map[string]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newClient returns an ECS client for the fake server using credentials
+func (f *fakeECSServer) newClient(t *testing.T, credentials *credentialsProvider) *ecsClientWrapper {
+	policy, err := getRetryPolicy(map[string]string{})
+	require.NoError(t, err)
+	client, err := newEcsClientWrapper(&openapi.Config{
+		Endpoint:   tea.String(strings.TrimPrefix(f.URL, "http://")),
+		Protocol:   tea.String("http"),
+		Credential: &openapiCredential{provider: credentials},
+		RegionId:   tea.String("cn-hangzhou"),
+	}, newTestLogger(), policy)
+	require.NoError(t, err)
+	return client
+}
+
+func (f *fakeECSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Header.Get("x-acs-action") {
+	case "DescribeDisks":
+		var diskIDs []string
+		if err := json.Unmarshal([]byte(r.Form.Get("DiskIds")), &diskIDs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		disks := []map[string]any{}
+		for _, id := range diskIDs {
+			status := diskStatusInUse
+			if _, ok := f.disks[id]; ok {
+				status = diskStatusAvailable
+			}
+			disks = append(disks, map[string]any{"DiskId": id, "ZoneId": "cn-hangzhou-h", "Status": status, "Tags": map[string]any{"Tag": []any{}}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"RequestId": "1", "Disks": map[string]any{"Disk": disks}})
+
+	case "CreateDisk":
+		id, ok := f.tokens[r.Form.Get("ClientToken")]
+		if !ok {
+			f.createdDisks++
+			id = fmt.Sprintf("d-new-%d", f.createdDisks)
+			f.tokens[r.Form.Get("ClientToken")] = id
+			f.disks[id] = fakeResource{source: r.Form.Get("SnapshotId"), key: fakeIdempotencyKey(r.Form)}
+		}
+		if f.failCreateDisks > 0 {
+			f.failCreateDisks--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"Code":"ServiceUnavailable","Message":"The request has failed due to a temporary failure of the server.","RequestId":"6"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"RequestId":"6","DiskId":%q}`, id)
+
+	case "CreateSnapshot":
+		id, ok := f.tokens[r.Form.Get("ClientToken")]
+		if !ok {
+			f.created++
+			id = fmt.Sprintf("s-%d", f.created)
+			f.tokens[r.Form.Get("ClientToken")] = id
+			f.snapshots[id] = fakeResource{source: r.Form.Get("DiskId"), key: fakeIdempotencyKey(r.Form)}
+		}
+		fmt.Fprintf(w, `{"RequestId":"2","SnapshotId":%q}`, id)
+
+	case "DescribeSnapshots":
+		snapshots := []map[string]any{}
+		if snapshotIDs := r.Form.Get("SnapshotIds"); snapshotIDs != "" {
+			var ids []string
+			if err := json.Unmarshal([]byte(snapshotIDs), &ids); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			for _, id := range ids {
+				snapshots = append(snapshots, map[string]any{"SnapshotId": id, "Status": snapshotStatusAccomplished, "Tags": map[string]any{"Tag": []any{}}})
+			}
+		} else {
+			for id, snapshot := range f.snapshots {
+				if snapshot.source == r.Form.Get("DiskId") && snapshot.key == r.Form.Get("Tag.1.Value") {
+					snapshots = append(snapshots, map[string]any{"SnapshotId": id, "Status": "progressing"})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"RequestId": "5", "Snapshots": map[string]any{"Snapshot": snapshots}})
+
+	case "DeleteSnapshot":
+		id := r.Form.Get("SnapshotId")
+		if _, ok := f.snapshots[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Code":"InvalidSnapshotId.NotFound","Message":"The specified snapshot is not found.","RequestId":"3"}`)
+			return
+		}
+		delete(f.snapshots, id)
+		fmt.Fprint(w, `{"RequestId":"3"}`)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"Code":"InvalidAction","Message":"unknown action","RequestId":"4"}`)
+	}
+}
+
+// fakeIdempotencyKey returns the value of the idempotency key tag of a request
+func fakeIdempotencyKey(form url.Values) string {
+	for i := 1; form.Has(fmt.Sprintf("Tag.%d.Key", i)); i++ {
+		if form.Get(fmt.Sprintf("Tag.%d.Key", i)) == idempotencyKeyTagKey {
+			return form.Get(fmt.Sprintf("Tag.%d.Value", i))
+		}
+	}
+	return ""
+}
+
+func TestVolumeSnapshotter_ConcurrentCreateAndDeleteSnapshot(t *testing.T) {
+	server := newFakeECSServer(t)
+
+	// The credentials are within the refresh window, so they are refreshed in the
+	// background while the requests are signed
+	var fetches atomic.Int32
+	credentials := newCachedCredentialsProvider(newTestLogger(),
+		&ossCredentials{accessKeyID: "ak", accessKeySecret: "sk", stsToken: "token-0", expiration: time.Now().Add(2 * time.Minute)},
+		func(ctx context.Context) (*ossCredentials, error) {
+			n := fetches.Add(1)
+			return &ossCredentials{
+				accessKeyID:     "ak",
+				accessKeySecret: "sk",
+				stsToken:        fmt.Sprintf("token-%d", n),
+				expiration:      time.Now().Add(2 * time.Minute),
+			}, nil
+		})
+
+	b := &VolumeSnapshotter{
+		log:            newTestLogger(),
+		region:         "cn-hangzhou",
+		credentials:    credentials,
+		client:         server.newClient(t, credentials),
+		supportedZones: map[string]bool{},
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			volumeID := fmt.Sprintf("d-%d", i)
+			for j := range 3 {
+				snapshotID, err := b.CreateSnapshot(volumeID, "cn-hangzhou-h", map[string]string{"velero.io/backup": fmt.Sprintf("backup-%d", j)})
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.NoError(t, b.DeleteSnapshot(snapshotID))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 24, server.created)
+	assert.Empty(t, server.snapshots)
+	assert.Eventually(t, func() bool { return fetches.Load() > 0 }, time.Second, time.Millisecond)
+}
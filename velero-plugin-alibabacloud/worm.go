@@ -0,0 +1,139 @@
+/*
+Copyright 2017, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkg/errors"
+)
+
+// isNoWormConfiguration reports whether err means the bucket has no WORM retention policy
+func isNoWormConfiguration(err error) bool {
+	var serviceErr *ossv2.ServiceError
+	return errors.As(err, &serviceErr) && serviceErr.StatusCode == 404 && serviceErr.Code == "NoSuchWORMConfiguration"
+}
+
+// isWormProtected reports whether err is OSS refusing to change an object under a WORM retention policy
+func isWormProtected(err error) bool {
+	var serviceErr *ossv2.ServiceError
+	return errors.As(err, &serviceErr) && serviceErr.StatusCode == 409 && serviceErr.Code == "FileImmutable"
+}
+
+// retentionDays returns the retention period of a WORM policy in days
+func retentionDays(worm *ossv2.WormConfiguration) int32 {
+	if worm.RetentionPeriodInDays == nil {
+		return 0
+	}
+	return *worm.RetentionPeriodInDays
+}
+
+// getWormConfiguration returns the WORM retention policy of the bucket, or nil if it has none
+func (o *ObjectStore) getWormConfiguration(ctx context.Context, bucket string) (*ossv2.WormConfiguration, error) {
+	result, err := o.client.GetBucketWorm(ctx, &ossv2.GetBucketWormRequest{Bucket: ossv2.Ptr(bucket)})
+	if err != nil {
+		if isNoWormConfiguration(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get WORM retention policy of bucket %s", bucket)
+	}
+	return result.WormConfiguration, nil
+}
+
+// ensureWormPolicy verifies that the bucket has a locked WORM retention policy of at
+// least days. With configure, a missing policy is created and locked, an unlocked one
+// is locked and a shorter one is extended. Locking a policy cannot be undone: objects
+// can no longer be deleted or overwritten until their retention period has passed.
+func (o *ObjectStore) ensureWormPolicy(ctx context.Context, bucket string, days int32, configure bool) error {
+	worm, err := o.getWormConfiguration(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	if worm == nil {
+		if !configure {
+			return errors.Errorf("bucket %s has no WORM retention policy, set %s to true to create one", bucket, wormConfigurePolicyConfigKey)
+		}
+		result, err := o.client.InitiateBucketWorm(ctx, &ossv2.InitiateBucketWormRequest{
+			Bucket:                    ossv2.Ptr(bucket),
+			InitiateWormConfiguration: &ossv2.InitiateWormConfiguration{RetentionPeriodInDays: ossv2.Ptr(days)},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create WORM retention policy of bucket %s", bucket)
+		}
+		o.log.Infof("created WORM retention policy of %d days on bucket %s", days, bucket)
+		worm = &ossv2.WormConfiguration{
+			WormId:                result.WormId,
+			State:                 ossv2.BucketWormStateInProgress,
+			RetentionPeriodInDays: ossv2.Ptr(days),
+		}
+	}
+
+	retention := retentionDays(worm)
+	if worm.State != ossv2.BucketWormStateLocked {
+		if retention < days {
+			return errors.Errorf("unlocked WORM retention policy of bucket %s retains objects for %d days, less than the required %d days",
+				bucket, retention, days)
+		}
+		if !configure {
+			return errors.Errorf("WORM retention policy of bucket %s is not locked, set %s to true to lock it", bucket, wormConfigurePolicyConfigKey)
+		}
+		if _, err := o.client.CompleteBucketWorm(ctx, &ossv2.CompleteBucketWormRequest{
+			Bucket: ossv2.Ptr(bucket),
+			WormId: worm.WormId,
+		}); err != nil {
+			return errors.Wrapf(err, "failed to lock WORM retention policy of bucket %s", bucket)
+		}
+		o.log.Infof("locked WORM retention policy of %d days on bucket %s", retention, bucket)
+	}
+
+	if retention < days {
+		if !configure {
+			return errors.Errorf("WORM retention policy of bucket %s retains objects for %d days, less than the required %d days",
+				bucket, retention, days)
+		}
+		if _, err := o.client.ExtendBucketWorm(ctx, &ossv2.ExtendBucketWormRequest{
+			Bucket:                  ossv2.Ptr(bucket),
+			WormId:                  worm.WormId,
+			ExtendWormConfiguration: &ossv2.ExtendWormConfiguration{RetentionPeriodInDays: ossv2.Ptr(days)},
+		}); err != nil {
+			return errors.Wrapf(err, "failed to extend WORM retention policy of bucket %s to %d days", bucket, days)
+		}
+		o.log.Infof("extended WORM retention policy of bucket %s from %d to %d days", bucket, retention, days)
+		retention = days
+	}
+
+	o.log.Infof("bucket %s has a locked WORM retention policy of %d days", bucket, retention)
+	return nil
+}
+
+// retainedUntil returns when the retention period of an object protected by the
+// WORM policy of its bucket ends, or the zero time if it cannot be determined
+func (o *ObjectStore) retainedUntil(ctx context.Context, bucket, key string) time.Time {
+	worm, err := o.getWormConfiguration(ctx, bucket)
+	if err != nil || worm == nil {
+		return time.Time{}
+	}
+
+	head, err := o.client.HeadObject(ctx, &ossv2.HeadObjectRequest{
+		Bucket: ossv2.Ptr(bucket),
+		Key:    ossv2.Ptr(key),
+	})
+	if err != nil || head.LastModified == nil {
+		return time.Time{}
+	}
+	return head.LastModified.AddDate(0, 0, int(retentionDays(worm)))
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018, 2019 the Velero contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ossv2 "github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEnsureWormPolicy(t *testing.T) {
+	noPolicy := &ossv2.ServiceError{StatusCode: 404, Code: "NoSuchWORMConfiguration"}
+	locked := func(days int32) *ossv2.GetBucketWormResult {
+		return &ossv2.GetBucketWormResult{WormConfiguration: &ossv2.WormConfiguration{
+			WormId:                ossv2.Ptr("worm-id"),
+			State:                 ossv2.BucketWormStateLocked,
+			RetentionPeriodInDays: ossv2.Ptr(days),
+		}}
+	}
+	inProgress := &ossv2.GetBucketWormResult{WormConfiguration: &ossv2.WormConfiguration{
+		WormId:                ossv2.Ptr("worm-id"),
+		State:                 ossv2.BucketWormStateInProgress,
+		RetentionPeriodInDays: ossv2.Ptr(int32(30)),
+	}}
+	wormID := mock.MatchedBy(func(req *ossv2.CompleteBucketWormRequest) bool {
+		return ossv2.ToString(req.WormId) == "worm-id"
+	})
+
+	tests := []struct {
+		name          string
+		configure     bool
+		setupMock     func(client *mockOSSClient)
+		expectedError string
+	}{
+		{
+			name: "locked policy is long enough",
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(locked(60), nil)
+			},
+		},
+		{
+			name: "missing policy",
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(nil, noPolicy)
+			},
+			expectedError: "bucket bucket has no WORM retention policy, set wormConfigurePolicy to true to create one",
+		},
+		{
+			name:      "missing policy is created and locked",
+			configure: true,
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(nil, noPolicy)
+				client.On("InitiateBucketWorm", mock.Anything, mock.MatchedBy(func(req *ossv2.InitiateBucketWormRequest) bool {
+					return *req.InitiateWormConfiguration.RetentionPeriodInDays == 30
+				})).Return(&ossv2.InitiateBucketWormResult{WormId: ossv2.Ptr("worm-id")}, nil)
+				client.On("CompleteBucketWorm", mock.Anything, wormID).Return(&ossv2.CompleteBucketWormResult{}, nil)
+			},
+		},
+		{
+			name: "unlocked policy",
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(inProgress, nil)
+			},
+			expectedError: "WORM retention policy of bucket bucket is not locked",
+		},
+		{
+			name:      "unlocked policy is locked",
+			configure: true,
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(inProgress, nil)
+				client.On("CompleteBucketWorm", mock.Anything, wormID).Return(&ossv2.CompleteBucketWormResult{}, nil)
+			},
+		},
+		{
+			name: "locked policy is too short",
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(locked(7), nil)
+			},
+			expectedError: "retains objects for 7 days, less than the required 30 days",
+		},
+		{
+			name:      "locked policy is extended",
+			configure: true,
+			setupMock: func(client *mockOSSClient) {
+				client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(locked(7), nil)
+				client.On("ExtendBucketWorm", mock.Anything, mock.MatchedBy(func(req *ossv2.ExtendBucketWormRequest) bool {
+					return ossv2.ToString(req.WormId) == "worm-id" && *req.ExtendWormConfiguration.RetentionPeriodInDays == 30
+				})).Return(&ossv2.ExtendBucketWormResult{}, nil)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := new(mockOSSClient)
+			defer client.AssertExpectations(t)
+			tc.setupMock(client)
+
+			o := &ObjectStore{log: newTestLogger(), client: client}
+			err := o.ensureWormPolicy(context.Background(), "bucket", 30, tc.configure)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeleteObject_WormProtected(t *testing.T) {
+	lastModified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	client := new(mockOSSClient)
+	defer client.AssertExpectations(t)
+	client.On("DeleteObject", mock.Anything, mock.Anything).Return(nil, &ossv2.ServiceError{StatusCode: 409, Code: "FileImmutable"})
+	client.On("GetBucketWorm", mock.Anything, mock.Anything).Return(&ossv2.GetBucketWormResult{WormConfiguration: &ossv2.WormConfiguration{
+		State:                 ossv2.BucketWormStateLocked,
+		RetentionPeriodInDays: ossv2.Ptr(int32(30)),
+	}}, nil)
+	client.On("HeadObject", mock.Anything, mock.Anything).Return(&ossv2.HeadObjectResult{LastModified: &lastModified}, nil)
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	o := &ObjectStore{log: logger, client: client}
+	assert.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	assert.Contains(t, logs.String(), "object backups/b1/b1.tar.gz in bucket bucket is retained until 2026-02-01T03:04:05Z")
+}
+
+func TestDeleteObject_Error(t *testing.T) {
+	client := new(mockOSSClient)
+	client.On("DeleteObject", mock.Anything, mock.Anything).Return(nil, &ossv2.ServiceError{StatusCode: 403, Code: "AccessDenied"})
+
+	o := &ObjectStore{log: newTestLogger(), client: client}
+	assert.ErrorContains(t, o.DeleteObject("bucket", "key"), "failed to delete object key from bucket bucket")
+}